@@ -14,6 +14,9 @@ type SinVoiceModule struct {
 	adsr *components.ADSR
 	osc  *components.Osc
 	pan  float64
+
+	// Sample offset of a pending note off in the next block, -1 if none
+	noteOffOffset int32
 }
 
 // NewSinVoiceModule new voice module
@@ -26,6 +29,7 @@ func NewSinVoiceModule(buflen int32, sr float64) farsounds.VoiceModule {
 	sinVoiceModule.adsr = components.NewADSR()
 	sinVoiceModule.osc = components.NewOsc(farsounds.SineTable, 0, 100.0/sr, 1.0)
 	sinVoiceModule.pan = 0.5
+	sinVoiceModule.noteOffOffset = -1
 
 	return sinVoiceModule
 }
@@ -37,6 +41,11 @@ func (module *SinVoiceModule) DSP(timestamp int64) {
 	rightOutput := module.Outlets[1].Buffer
 
 	for i := int32(0); i < buflen; i++ {
+		if i == module.noteOffOffset {
+			module.NoteOff()
+			module.noteOffOffset = -1
+		}
+
 		value := module.adsr.Process() * module.osc.Process(0)
 		left, right := components.SinusoidalPanning(value, module.pan)
 		leftOutput[i] = left
@@ -54,6 +63,11 @@ func (module *SinVoiceModule) NoteOff() {
 	module.adsr.Gate(0.0)
 }
 
+// NoteOffAt closes the gate at a sample offset in the next block
+func (module *SinVoiceModule) NoteOffAt(offset int32) {
+	module.noteOffOffset = offset
+}
+
 // NoteOn action
 func (module *SinVoiceModule) NoteOn(duration float64, sr float64, settings interface{}) {
 	settingsMap, ok := settings.(map[string]interface{})
@@ -67,8 +81,21 @@ func (module *SinVoiceModule) NoteOn(duration float64, sr float64, settings inte
 	module.adsr.SetSustainLevel(0.3)
 	module.adsr.Gate(1.0)
 
+	module.Update(settingsMap)
+
+	module.osc.Phase = 0.0
+	module.noteOffOffset = -1
+}
+
+// Update frequency, amplitude and pan of a sounding voice
+func (module *SinVoiceModule) Update(settings interface{}) {
+	settingsMap, ok := settings.(map[string]interface{})
+	if !ok {
+		return
+	}
+
 	if frequency, ok := settingsMap["frequency"].(float64); ok {
-		module.osc.Inc = frequency / sr
+		module.osc.Inc = frequency / module.GetSampleRate()
 	}
 
 	if amplitude, ok := settingsMap["amplitude"].(float64); ok {
@@ -78,6 +105,4 @@ func (module *SinVoiceModule) NoteOn(duration float64, sr float64, settings inte
 	if pan, ok := settingsMap["pan"].(float64); ok {
 		module.pan = pan
 	}
-
-	module.osc.Phase = 0.0
 }
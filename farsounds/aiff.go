@@ -0,0 +1,246 @@
+package farsounds
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+/*
+	Pure Go AIFF codec
+*/
+
+// AIFC version timestamp
+const aifcVersion1 = 0xA2805140
+
+// encodeExtended encodes a float as 80 bit IEEE 754 extended precision, used
+// for the sample rate in the COMM chunk
+func encodeExtended(value float64) []byte {
+	b := make([]byte, 10)
+
+	if value <= 0 {
+		return b
+	}
+
+	exponent := int(math.Floor(math.Log2(value)))
+	mantissa := uint64(math.Ldexp(value, 63-exponent))
+
+	binary.BigEndian.PutUint16(b[0:], uint16(exponent+16383))
+	binary.BigEndian.PutUint64(b[2:], mantissa)
+
+	return b
+}
+
+// decodeExtended decodes an 80 bit IEEE 754 extended precision float
+func decodeExtended(b []byte) float64 {
+	exponent := int(binary.BigEndian.Uint16(b[0:]) & 0x7FFF)
+	mantissa := binary.BigEndian.Uint64(b[2:])
+
+	if exponent == 0 && mantissa == 0 {
+		return 0
+	}
+
+	value := math.Ldexp(float64(mantissa), exponent-16383-63)
+
+	if b[0]&0x80 != 0 {
+		value = -value
+	}
+
+	return value
+}
+
+// writeAIFFHeader writes the FORM, COMM and SSND chunk headers, float samples
+// are written as AIFC. numFrames is -1 if the number of frames is not known
+func writeAIFFHeader(w io.Writer, channels int32, samplerate int32, codec *pcmCodec, numFrames int64) error {
+	be := binary.BigEndian
+	blockAlign := uint32(channels) * uint32(codec.bytesPerSample())
+
+	var compressionType string
+	var compressionName string
+
+	if codec.float {
+		if codec.bits == 32 {
+			compressionType = "fl32"
+			compressionName = "32-bit floating point"
+		} else {
+			compressionType = "fl64"
+			compressionName = "64-bit floating point"
+		}
+	}
+
+	// Pascal string padded to an even length
+	pstring := append([]byte{byte(len(compressionName))}, compressionName...)
+	if len(pstring)&1 == 1 {
+		pstring = append(pstring, 0)
+	}
+
+	commSize := uint32(18)
+	if codec.float {
+		commSize += 4 + uint32(len(pstring))
+	}
+
+	fverSize := uint32(0)
+	if codec.float {
+		fverSize = 12
+	}
+
+	frames := uint32(0xFFFFFFFF)
+	ssndSize := uint32(0xFFFFFFFF)
+	formSize := uint32(0xFFFFFFFF)
+
+	if numFrames >= 0 {
+		size := uint64(numFrames) * uint64(blockAlign)
+		if size+uint64(commSize)+uint64(fverSize)+36 > 0xFFFFFFFF {
+			return errors.New("Sound file too large for aiff")
+		}
+
+		dataSize := uint32(size)
+		frames = uint32(numFrames)
+		ssndSize = 8 + dataSize
+		formSize = 4 + fverSize + 8 + commSize + 8 + ssndSize + (dataSize & 1)
+	}
+
+	header := make([]byte, 0, 96)
+
+	header = append(header, "FORM"...)
+	header = be.AppendUint32(header, formSize)
+
+	if codec.float {
+		header = append(header, "AIFC"...)
+		header = append(header, "FVER"...)
+		header = be.AppendUint32(header, 4)
+		header = be.AppendUint32(header, aifcVersion1)
+	} else {
+		header = append(header, "AIFF"...)
+	}
+
+	header = append(header, "COMM"...)
+	header = be.AppendUint32(header, commSize)
+	header = be.AppendUint16(header, uint16(channels))
+	header = be.AppendUint32(header, frames)
+	header = be.AppendUint16(header, uint16(codec.bits))
+	header = append(header, encodeExtended(float64(samplerate))...)
+
+	if codec.float {
+		header = append(header, compressionType...)
+		header = append(header, pstring...)
+	}
+
+	header = append(header, "SSND"...)
+	header = be.AppendUint32(header, ssndSize)
+	header = be.AppendUint32(header, 0)
+	header = be.AppendUint32(header, 0)
+
+	_, err := w.Write(header)
+
+	return err
+}
+
+// readAIFFHeader reads chunks up to the sound data
+func readAIFFHeader(r io.Reader) (*pcmReader, error) {
+	be := binary.BigEndian
+
+	// Read FORM header, already checked
+	form := make([]byte, 12)
+
+	_, err := io.ReadFull(r, form)
+	if err != nil {
+		return nil, err
+	}
+
+	isAIFC := string(form[8:12]) == "AIFC"
+
+	var codec *pcmCodec
+	info := soundFileInfo{}
+
+	for {
+		header, err := readChunkHeader(r, be)
+		if err != nil {
+			return nil, err
+		}
+
+		switch string(header.id[:]) {
+		case "COMM":
+			if header.size < 18 {
+				return nil, errors.New("Invalid aiff COMM chunk")
+			}
+
+			body := make([]byte, header.size+header.size&1)
+
+			_, err = io.ReadFull(r, body)
+			if err != nil {
+				return nil, err
+			}
+
+			info.channels = int32(be.Uint16(body[0:]))
+			numFrames := be.Uint32(body[2:])
+			bits := int(be.Uint16(body[6:]))
+			info.samplerate = int32(decodeExtended(body[8:18]) + 0.5)
+
+			info.frames = int64(numFrames)
+			if numFrames == 0xFFFFFFFF {
+				info.frames = -1
+			}
+
+			compressionType := "NONE"
+			if isAIFC {
+				if header.size < 22 {
+					return nil, errors.New("Invalid aifc COMM chunk")
+				}
+
+				compressionType = string(body[18:22])
+			}
+
+			switch compressionType {
+			case "NONE", "twos":
+				codec = &pcmCodec{bits: bits, order: be}
+			case "sowt":
+				codec = &pcmCodec{bits: bits, order: binary.LittleEndian}
+			case "fl32", "FL32":
+				codec = &pcmCodec{bits: 32, float: true, order: be}
+			case "fl64", "FL64":
+				codec = &pcmCodec{bits: 64, float: true, order: be}
+			default:
+				return nil, fmt.Errorf("Unsupported aifc compression %v", compressionType)
+			}
+
+			if !codec.float && !isPCMBits(codec.bits) {
+				return nil, fmt.Errorf("Unsupported aiff sample size %d", bits)
+			}
+
+			if info.channels < 1 {
+				return nil, errors.New("Invalid aiff channel count")
+			}
+		case "SSND":
+			if codec == nil {
+				return nil, errors.New("Aiff SSND chunk before COMM chunk")
+			}
+
+			offsets := make([]byte, 8)
+
+			_, err = io.ReadFull(r, offsets)
+			if err != nil {
+				return nil, err
+			}
+
+			// Skip to start of sound data
+			_, err = io.CopyN(io.Discard, r, int64(be.Uint32(offsets[0:])))
+			if err != nil {
+				return nil, err
+			}
+
+			pcm := &pcmReader{codec: codec}
+			pcm.info = info
+			pcm.remaining = info.frames * int64(info.channels)
+
+			return pcm, nil
+		default:
+			err = skipChunk(r, header.size)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}
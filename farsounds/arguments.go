@@ -0,0 +1,426 @@
+package farsounds
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+/*
+	Script arguments
+*/
+
+// ScriptPatchReferenceDescriptor for script mapping of a sub-patch script
+// with arguments
+type ScriptPatchReferenceDescriptor struct {
+	File      string
+	Arguments map[string]interface{}
+}
+
+// argumentReference is a $name or ${name} reference in a script string
+type argumentReference struct {
+	name       string
+	start, end int
+}
+
+// isArgumentStart returns true if c can start an argument name
+func isArgumentStart(c rune) bool {
+	return c == '_' || unicode.IsLetter(c)
+}
+
+// isArgumentChar returns true if c can be part of an argument name
+func isArgumentChar(c rune) bool {
+	return c == '_' || unicode.IsLetter(c) || unicode.IsDigit(c)
+}
+
+// argumentReferenceAt returns the reference that starts with the $ at i,
+// false if there is no valid reference
+func argumentReferenceAt(runes []rune, i int) (argumentReference, bool) {
+	switch {
+	case i+1 < len(runes) && runes[i+1] == '{':
+		end := i + 2
+		for end < len(runes) && runes[end] != '}' {
+			end++
+		}
+
+		if end == len(runes) {
+			return argumentReference{}, false
+		}
+
+		return argumentReference{
+			name:  string(runes[i+2 : end]),
+			start: i,
+			end:   end + 1,
+		}, true
+	case i+1 < len(runes) && isArgumentStart(runes[i+1]):
+		end := i + 1
+		for end < len(runes) && isArgumentChar(runes[end]) {
+			end++
+		}
+
+		return argumentReference{
+			name:  string(runes[i+1 : end]),
+			start: i,
+			end:   end,
+		}, true
+	}
+
+	return argumentReference{}, false
+}
+
+// argumentReferences returns the references in s, $$ is an escaped $
+func argumentReferences(s string) ([]argumentReference, error) {
+	var references []argumentReference
+
+	runes := []rune(s)
+
+	for i := 0; i < len(runes); i++ {
+		if runes[i] != '$' {
+			continue
+		}
+
+		if i+1 < len(runes) && runes[i+1] == '$' {
+			i++
+			continue
+		}
+
+		reference, ok := argumentReferenceAt(runes, i)
+		if !ok {
+			if i+1 < len(runes) && runes[i+1] == '{' {
+				return nil, fmt.Errorf("Unclosed argument reference in %q", s)
+			}
+
+			return nil, fmt.Errorf("Invalid argument reference in %q", s)
+		}
+
+		references = append(references, reference)
+
+		i = reference.end - 1
+	}
+
+	return references, nil
+}
+
+// substituteArguments returns a copy of a script value with the argument
+// references in its strings replaced. A string that is a single reference
+// becomes the argument value, a string that is an arithmetic expression of
+// number arguments becomes a number and other strings get the text of the
+// arguments. Strings of only references, numbers, operators and parentheses
+// that do not parse as an expression are an error
+func substituteArguments(value interface{}, arguments map[string]interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		substituted := make(map[string]interface{}, len(v))
+
+		for key, element := range v {
+			s, err := substituteArguments(element, arguments)
+			if err != nil {
+				return nil, err
+			}
+
+			substituted[key] = s
+		}
+
+		return substituted, nil
+	case []interface{}:
+		substituted := make([]interface{}, len(v))
+
+		for i, element := range v {
+			s, err := substituteArguments(element, arguments)
+			if err != nil {
+				return nil, err
+			}
+
+			substituted[i] = s
+		}
+
+		return substituted, nil
+	case string:
+		return substituteString(v, arguments)
+	}
+
+	return value, nil
+}
+
+// substituteString replaces the argument references of a string
+func substituteString(s string, arguments map[string]interface{}) (interface{}, error) {
+	if !strings.Contains(s, "$") {
+		return s, nil
+	}
+
+	references, err := argumentReferences(s)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, reference := range references {
+		if _, ok := arguments[reference.name]; !ok {
+			return nil, fmt.Errorf("Unknown argument %v in %q", reference.name, s)
+		}
+	}
+
+	runes := []rune(s)
+
+	if len(references) == 1 && references[0].start == 0 && references[0].end == len(runes) {
+		return arguments[references[0].name], nil
+	}
+
+	if len(references) > 0 {
+		numbers := make(map[string]float64, len(references))
+		isExpression := true
+
+		for _, reference := range references {
+			number, ok := arguments[reference.name].(float64)
+			if !ok {
+				isExpression = false
+				break
+			}
+
+			numbers[reference.name] = number
+		}
+
+		if isExpression {
+			result, err := EvalExpression(s, numbers)
+			if err == nil {
+				return result, nil
+			}
+
+			if errors.Is(err, errDivisionByZero) || isExpressionText(runes, references) {
+				return nil, fmt.Errorf("%v %q", err, s)
+			}
+		}
+	}
+
+	// Text substitution, escaped $ are only in the text between references
+	var builder strings.Builder
+
+	position := 0
+
+	for _, reference := range references {
+		builder.WriteString(strings.Replace(string(runes[position:reference.start]), "$$", "$", -1))
+		builder.WriteString(argumentText(arguments[reference.name]))
+		position = reference.end
+	}
+
+	builder.WriteString(strings.Replace(string(runes[position:]), "$$", "$", -1))
+
+	return builder.String(), nil
+}
+
+// isExpressionText returns true if the text around the references of a
+// string has nothing but numbers, operators and parentheses, the string is
+// meant as an expression
+func isExpressionText(runes []rune, references []argumentReference) bool {
+	var text []rune
+
+	position := 0
+
+	for _, reference := range references {
+		text = append(text, runes[position:reference.start]...)
+		position = reference.end
+	}
+
+	text = append(text, runes[position:]...)
+
+	for _, c := range text {
+		if !unicode.IsSpace(c) && !unicode.IsDigit(c) && !strings.ContainsRune(".+-*/%()", c) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// argumentText returns the text of an argument value
+func argumentText(value interface{}) string {
+	if number, ok := value.(float64); ok {
+		return strconv.FormatFloat(number, 'g', -1, 64)
+	}
+
+	return fmt.Sprint(value)
+}
+
+/*
+	Expressions
+*/
+
+// errDivisionByZero is returned for expressions that divide by zero
+var errDivisionByZero = errors.New("Division by zero in expression")
+
+// expressionParser is a recursive descent parser for arithmetic expressions
+type expressionParser struct {
+	runes     []rune
+	position  int
+	variables map[string]float64
+}
+
+// EvalExpression evaluates an arithmetic expression with numbers, variables
+// as $name or ${name}, + - * / %, unary minus and parentheses
+func EvalExpression(expression string, variables map[string]float64) (float64, error) {
+	parser := expressionParser{
+		runes:     []rune(expression),
+		variables: variables,
+	}
+
+	value, err := parser.sum()
+	if err != nil {
+		return 0.0, err
+	}
+
+	if parser.peek() != 0 {
+		return 0.0, fmt.Errorf("Unexpected %q in expression %q", parser.peek(), expression)
+	}
+
+	return value, nil
+}
+
+// peek returns the next character that is not a space, 0 at the end
+func (parser *expressionParser) peek() rune {
+	for parser.position < len(parser.runes) && unicode.IsSpace(parser.runes[parser.position]) {
+		parser.position++
+	}
+
+	if parser.position == len(parser.runes) {
+		return 0
+	}
+
+	return parser.runes[parser.position]
+}
+
+// sum parses terms separated by + and -
+func (parser *expressionParser) sum() (float64, error) {
+	value, err := parser.product()
+	if err != nil {
+		return 0.0, err
+	}
+
+	for {
+		op := parser.peek()
+		if op != '+' && op != '-' {
+			return value, nil
+		}
+
+		parser.position++
+
+		right, err := parser.product()
+		if err != nil {
+			return 0.0, err
+		}
+
+		if op == '+' {
+			value += right
+		} else {
+			value -= right
+		}
+	}
+}
+
+// product parses factors separated by *, / and %
+func (parser *expressionParser) product() (float64, error) {
+	value, err := parser.factor()
+	if err != nil {
+		return 0.0, err
+	}
+
+	for {
+		op := parser.peek()
+		if op != '*' && op != '/' && op != '%' {
+			return value, nil
+		}
+
+		parser.position++
+
+		right, err := parser.factor()
+		if err != nil {
+			return 0.0, err
+		}
+
+		switch op {
+		case '*':
+			value *= right
+		case '/':
+			if right == 0.0 {
+				return 0.0, errDivisionByZero
+			}
+
+			value /= right
+		case '%':
+			if right == 0.0 {
+				return 0.0, errDivisionByZero
+			}
+
+			value = math.Mod(value, right)
+		}
+	}
+}
+
+// factor parses a number, variable, signed factor or expression in
+// parentheses
+func (parser *expressionParser) factor() (float64, error) {
+	c := parser.peek()
+
+	switch {
+	case c == '-' || c == '+':
+		parser.position++
+
+		value, err := parser.factor()
+		if c == '-' {
+			value = -value
+		}
+
+		return value, err
+	case c == '(':
+		parser.position++
+
+		value, err := parser.sum()
+		if err != nil {
+			return 0.0, err
+		}
+
+		if parser.peek() != ')' {
+			return 0.0, errors.New("Missing ) in expression")
+		}
+
+		parser.position++
+
+		return value, nil
+	case c == '$':
+		reference, ok := argumentReferenceAt(parser.runes, parser.position)
+		if !ok {
+			return 0.0, errors.New("Invalid variable in expression")
+		}
+
+		value, ok := parser.variables[reference.name]
+		if !ok {
+			return 0.0, fmt.Errorf("Unknown variable %v in expression", reference.name)
+		}
+
+		parser.position = reference.end
+
+		return value, nil
+	case c == '.' || unicode.IsDigit(c):
+		start := parser.position
+
+		for parser.position < len(parser.runes) {
+			r := parser.runes[parser.position]
+
+			// Exponent signs are part of the number
+			isSign := (r == '-' || r == '+') && (parser.runes[parser.position-1] == 'e' || parser.runes[parser.position-1] == 'E')
+
+			if !unicode.IsDigit(r) && r != '.' && r != 'e' && r != 'E' && !isSign {
+				break
+			}
+
+			parser.position++
+		}
+
+		return strconv.ParseFloat(string(parser.runes[start:parser.position]), 64)
+	case c == 0:
+		return 0.0, errors.New("Unexpected end of expression")
+	}
+
+	return 0.0, fmt.Errorf("Unexpected %q in expression", c)
+}
@@ -0,0 +1,480 @@
+package farsounds
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+/*
+	Sound file backend interface
+*/
+
+// soundFileInfo describes the layout of a sound file
+type soundFileInfo struct {
+	channels   int32
+	samplerate int32
+	frames     int64
+}
+
+// soundFileWriter writes interleaved samples to a sound file
+type soundFileWriter interface {
+	// Write interleaved samples, samples must contain whole frames
+	WriteSamples(samples []float64) error
+
+	// Finish and close the sound file
+	Close() error
+}
+
+// soundFileReader reads interleaved samples from a sound file
+type soundFileReader interface {
+	// Info about the sound file
+	Info() soundFileInfo
+
+	// Read interleaved samples, returns the number of samples read and
+	// zero at the end of the file
+	ReadSamples(samples []float64) (int, error)
+
+	// Close the sound file
+	Close() error
+}
+
+// soundFileBackend creates and opens sound files. The backend is selected by
+// build tags, libsndfile is used when cgo is enabled, the pure Go codecs when
+// cgo is disabled or the purego build tag is set
+type soundFileBackend interface {
+	// Create a new sound file for writing
+	Create(filePath string, channels int32, samplerate int32, format *soundFormat) (soundFileWriter, error)
+
+	// Open an existing sound file for reading
+	Open(filePath string) (soundFileReader, error)
+
+	// Supports returns an error if sound files of format can not be created
+	Supports(format *soundFormat) error
+}
+
+/*
+	Pure Go codecs
+*/
+
+// pcmCodec converts samples to and from encoded bytes
+type pcmCodec struct {
+	// Bits per sample
+	bits int
+
+	// Samples are floating point
+	float bool
+
+	// Byte order of encoded samples
+	order binary.ByteOrder
+
+	// 8 bit samples are unsigned (wav)
+	unsigned8 bool
+}
+
+// isPCMBits returns true for the integer sample sizes the codecs decode
+func isPCMBits(bits int) bool {
+	return bits == 8 || bits == 16 || bits == 24 || bits == 32
+}
+
+// bytesPerSample returns the number of encoded bytes per sample
+func (codec *pcmCodec) bytesPerSample() int {
+	return (codec.bits + 7) / 8
+}
+
+// encode samples to bytes, integer samples are scaled by 2^(bits-1)-1,
+// rounded and clipped
+func (codec *pcmCodec) encode(samples []float64, out []byte) {
+	size := codec.bytesPerSample()
+
+	if codec.float {
+		for i, sample := range samples {
+			if codec.bits == 32 {
+				codec.order.PutUint32(out[i*4:], math.Float32bits(float32(sample)))
+			} else {
+				codec.order.PutUint64(out[i*8:], math.Float64bits(sample))
+			}
+		}
+
+		return
+	}
+
+	scale := math.Pow(2.0, float64(codec.bits-1)) - 1.0
+
+	for i, sample := range samples {
+		value := math.RoundToEven(sample * scale)
+
+		if value > scale {
+			value = scale
+		} else if value < -scale-1.0 {
+			value = -scale - 1.0
+		}
+
+		v := int64(value)
+		b := out[i*size : i*size+size]
+
+		switch {
+		case size == 1 && codec.unsigned8:
+			b[0] = byte(v + 128)
+		case size == 1:
+			b[0] = byte(v)
+		case codec.order == binary.BigEndian:
+			for j := 0; j < size; j++ {
+				b[j] = byte(v >> uint(8*(size-1-j)))
+			}
+		default:
+			for j := 0; j < size; j++ {
+				b[j] = byte(v >> uint(8*j))
+			}
+		}
+	}
+}
+
+// decode bytes to samples, integer samples are scaled by 1/2^(bits-1)
+func (codec *pcmCodec) decode(in []byte, samples []float64) {
+	size := codec.bytesPerSample()
+
+	if codec.float {
+		for i := range samples {
+			if codec.bits == 32 {
+				samples[i] = float64(math.Float32frombits(codec.order.Uint32(in[i*4:])))
+			} else {
+				samples[i] = math.Float64frombits(codec.order.Uint64(in[i*8:]))
+			}
+		}
+
+		return
+	}
+
+	scale := 1.0 / math.Pow(2.0, float64(size*8-1))
+
+	for i := range samples {
+		b := in[i*size : i*size+size]
+		var v int64
+
+		switch {
+		case size == 1 && codec.unsigned8:
+			v = int64(b[0]) - 128
+		case size == 1:
+			v = int64(int8(b[0]))
+		case codec.order == binary.BigEndian:
+			for j := 0; j < size; j++ {
+				v = v<<8 | int64(b[j])
+			}
+		default:
+			for j := size - 1; j >= 0; j-- {
+				v = v<<8 | int64(b[j])
+			}
+		}
+
+		// Sign extend
+		shift := uint(64 - size*8)
+		v = (v << shift) >> shift
+
+		samples[i] = float64(v) * scale
+	}
+}
+
+// chunkHeader is a RIFF or IFF chunk header
+type chunkHeader struct {
+	id   [4]byte
+	size uint32
+}
+
+// readChunkHeader reads a chunk header in the given byte order
+func readChunkHeader(r io.Reader, order binary.ByteOrder) (chunkHeader, error) {
+	var buf [8]byte
+	header := chunkHeader{}
+
+	_, err := io.ReadFull(r, buf[:])
+	if err != nil {
+		return header, err
+	}
+
+	copy(header.id[:], buf[:4])
+	header.size = order.Uint32(buf[4:])
+
+	return header, nil
+}
+
+// skipChunk skips the chunk body including the pad byte
+func skipChunk(r io.Reader, size uint32) error {
+	_, err := io.CopyN(io.Discard, r, int64(size)+int64(size&1))
+	return err
+}
+
+/*
+	Pure Go sound file reader
+*/
+
+// pcmReader reads samples from the data chunk of a wav or aiff file
+type pcmReader struct {
+	file      *os.File
+	reader    io.Reader
+	codec     *pcmCodec
+	info      soundFileInfo
+	remaining int64
+	buffer    []byte
+}
+
+// Info about the sound file
+func (r *pcmReader) Info() soundFileInfo {
+	return r.info
+}
+
+// ReadSamples reads interleaved samples
+func (r *pcmReader) ReadSamples(samples []float64) (int, error) {
+	numSamples := int64(len(samples))
+	if numSamples > r.remaining {
+		numSamples = r.remaining
+	}
+
+	if numSamples == 0 {
+		return 0, nil
+	}
+
+	size := int64(r.codec.bytesPerSample())
+	if int64(len(r.buffer)) < numSamples*size {
+		r.buffer = make([]byte, numSamples*size)
+	}
+
+	buffer := r.buffer[:numSamples*size]
+
+	_, err := io.ReadFull(r.reader, buffer)
+	if err != nil {
+		return 0, err
+	}
+
+	r.codec.decode(buffer, samples[:numSamples])
+	r.remaining -= numSamples
+
+	return int(numSamples), nil
+}
+
+// Close the sound file
+func (r *pcmReader) Close() error {
+	return r.file.Close()
+}
+
+// openPCMFile opens a wav or aiff file with the pure Go decoders
+func openPCMFile(filePath string) (soundFileReader, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	reader := bufio.NewReader(file)
+
+	magic, err := reader.Peek(12)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	var pcm *pcmReader
+
+	switch {
+	case string(magic[:4]) == "RIFF" && string(magic[8:12]) == "WAVE":
+		pcm, err = readWAVHeader(reader)
+	case string(magic[:4]) == "FORM" && (string(magic[8:12]) == "AIFF" || string(magic[8:12]) == "AIFC"):
+		pcm, err = readAIFFHeader(reader)
+	default:
+		err = fmt.Errorf("Unsupported sound file %v", filePath)
+	}
+
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	// Streamed files have no data size, use the rest of the file
+	if pcm.info.frames < 0 {
+		err = pcm.framesFromFileSize(file, reader)
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+
+	pcm.file = file
+	pcm.reader = reader
+
+	return pcm, nil
+}
+
+// framesFromFileSize sets the number of frames from the bytes left in the file
+// after the header
+func (r *pcmReader) framesFromFileSize(file *os.File, reader *bufio.Reader) error {
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+
+	position, err := file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	dataSize := stat.Size() - position + int64(reader.Buffered())
+	frameSize := int64(r.info.channels) * int64(r.codec.bytesPerSample())
+
+	r.info.frames = dataSize / frameSize
+	r.remaining = r.info.frames * int64(r.info.channels)
+
+	return nil
+}
+
+/*
+	Pure Go sound file writer
+*/
+
+// pcmWriter writes samples to the data chunk of a wav or aiff file. If the
+// number of frames is not known up front the header is rewritten on close
+// when the output can seek, otherwise the sizes are left at their maximum
+type pcmWriter struct {
+	writer    *bufio.Writer
+	codec     *pcmCodec
+	buffer    []byte
+	channels  int32
+	frames    int64
+	numFrames int64
+
+	// Output to rewrite the header on, nil if the output can not seek
+	seeker io.WriteSeeker
+
+	// Offset of the header in the output
+	start int64
+
+	// Writes the header for a number of frames, -1 is unknown
+	writeHeader func(w io.Writer, numFrames int64) error
+
+	// Close the output when done
+	closer io.Closer
+}
+
+// newPCMWriter creates a pure Go wav or aiff writer on output, numFrames is
+// the total number of frames if known or -1
+func newPCMWriter(output io.Writer, channels int32, samplerate int32, format *soundFormat, numFrames int64) (*pcmWriter, error) {
+	w := &pcmWriter{
+		writer:    bufio.NewWriter(output),
+		channels:  channels,
+		numFrames: numFrames,
+	}
+
+	// Files on pipes and terminals implement Seek but fail on it
+	if seeker, ok := output.(io.WriteSeeker); ok {
+		start, err := seeker.Seek(0, io.SeekCurrent)
+		if err == nil {
+			w.seeker = seeker
+			w.start = start
+		}
+	}
+
+	switch format.fileFormat {
+	case "wav":
+		w.codec = &pcmCodec{bits: format.bits, float: format.float, order: binary.LittleEndian, unsigned8: true}
+		w.writeHeader = func(out io.Writer, n int64) error {
+			return writeWAVHeader(out, channels, samplerate, w.codec, n)
+		}
+	case "aiff":
+		w.codec = &pcmCodec{bits: format.bits, float: format.float, order: binary.BigEndian}
+		w.writeHeader = func(out io.Writer, n int64) error {
+			return writeAIFFHeader(out, channels, samplerate, w.codec, n)
+		}
+	default:
+		return nil, fmt.Errorf("File format %v is not supported by the pure Go backend", format.fileFormat)
+	}
+
+	err := w.writeHeader(w.writer, numFrames)
+	if err != nil {
+		return nil, err
+	}
+
+	return w, nil
+}
+
+// WriteSamples writes interleaved samples
+func (w *pcmWriter) WriteSamples(samples []float64) error {
+	size := len(samples) * w.codec.bytesPerSample()
+	if len(w.buffer) < size {
+		w.buffer = make([]byte, size)
+	}
+
+	w.codec.encode(samples, w.buffer[:size])
+	w.frames += int64(len(samples)) / int64(w.channels)
+
+	_, err := w.writer.Write(w.buffer[:size])
+
+	return err
+}
+
+// Close finishes the file, the header is rewritten if the number of frames
+// was not known or not correct and the output can seek
+func (w *pcmWriter) Close() error {
+	dataSize := w.frames * int64(w.channels) * int64(w.codec.bytesPerSample())
+
+	err := func() error {
+		if dataSize&1 == 1 {
+			err := w.writer.WriteByte(0)
+			if err != nil {
+				return err
+			}
+		}
+
+		err := w.writer.Flush()
+		if err != nil {
+			return err
+		}
+
+		if w.numFrames == w.frames {
+			return nil
+		}
+
+		if w.seeker == nil {
+			if w.numFrames >= 0 {
+				return errors.New("Number of frames written differs from header")
+			}
+
+			return nil
+		}
+
+		_, err = w.seeker.Seek(w.start, io.SeekStart)
+		if err != nil {
+			return err
+		}
+
+		return w.writeHeader(w.seeker, w.frames)
+	}()
+
+	if w.closer != nil {
+		closeErr := w.closer.Close()
+		if err == nil {
+			err = closeErr
+		}
+	}
+
+	return err
+}
+
+// createPCMFile creates a wav or aiff file with the pure Go encoders
+func createPCMFile(filePath string, channels int32, samplerate int32, format *soundFormat) (soundFileWriter, error) {
+	file, err := os.Create(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	w, err := newPCMWriter(file, channels, samplerate, format, -1)
+	if err != nil {
+		file.Close()
+		os.Remove(filePath)
+		return nil, err
+	}
+
+	w.closer = file
+
+	return w, nil
+}
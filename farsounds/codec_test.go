@@ -0,0 +1,32 @@
+package farsounds
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func TestReadHeaderSampleSize(t *testing.T) {
+	for _, bits := range []int{0, 12, 40, 72} {
+		var wav bytes.Buffer
+
+		// A zero sample size also makes the block align zero
+		codec := &pcmCodec{bits: bits, order: binary.LittleEndian, unsigned8: true}
+		writeWAVHeader(&wav, 1, 44100, codec, 16)
+		wav.Write(make([]byte, 64))
+
+		if _, err := readWAVHeader(&wav); err == nil {
+			t.Errorf("Wav with %d bit samples was read", bits)
+		}
+
+		var aiff bytes.Buffer
+
+		codec = &pcmCodec{bits: bits, order: binary.BigEndian}
+		writeAIFFHeader(&aiff, 1, 44100, codec, 16)
+		aiff.Write(make([]byte, 64))
+
+		if _, err := readAIFFHeader(&aiff); err == nil {
+			t.Errorf("Aiff with %d bit samples was read", bits)
+		}
+	}
+}
@@ -166,6 +166,9 @@ func (adsr *ADSR) Idle() bool {
 type ADSRModule struct {
 	*farsounds.BaseModule
 	*ADSR
+
+	// Messages due at a sample offset in the next block
+	messages farsounds.TimedMessageQueue
 }
 
 // NewADSRModule new ADSR module
@@ -200,6 +203,10 @@ func (module *ADSRModule) DSP(timestamp int64) {
 	}
 
 	for i := int32(0); i < buflen; i++ {
+		if module.messages.Len() > 0 {
+			module.messages.Deliver(i, module.Message)
+		}
+
 		if gateInput != nil {
 			module.Gate(gateInput[i])
 		}
@@ -208,6 +215,26 @@ func (module *ADSRModule) DSP(timestamp int64) {
 	}
 }
 
+// Maximum number of messages an ADSR module queues, modules that are not
+// processed, such as modules that are not connected to an outlet, never
+// deliver their queued messages
+const adsrMaxQueuedMessages = 1024
+
+// MessageAt queues a message, so a gate opens or closes at the exact sample.
+// A full queue is applied right away
+func (module *ADSRModule) MessageAt(message farsounds.Message, offset int32) {
+	if module.messages.Len() >= adsrMaxQueuedMessages {
+		module.messages.Flush(module.Message)
+	}
+
+	module.messages.Push(message, offset)
+}
+
+// FastForward delivers the queued messages without processing the envelope
+func (module *ADSRModule) FastForward(timestamp int64) {
+	module.messages.Deliver(module.GetBufferLength(), module.Message)
+}
+
 // Message received
 func (module *ADSRModule) Message(message farsounds.Message) {
 	sr := module.GetSampleRate()
@@ -56,6 +56,11 @@ const (
 	allpasstuningR4        = allpasstuningL4 + stereospread
 )
 
+// Default smoothing of the freeverb parameters in seconds, numbers sent to
+// wet, roomSize, dry, damp and width ramp over this time to avoid clicks. Send
+// a ramp with time 0 to jump
+const freeverbSmoothing = 0.05
+
 /*
    undenormalise
 */
@@ -180,6 +185,16 @@ type FreeVerbModule struct {
 	dry       float64
 	width     float64
 	mode      float64
+
+	// Smoothable parameters by message key, the filters are updated every
+	// sample while one of them ramps
+	params farsounds.ParamSet
+
+	wetParam      *farsounds.Param
+	roomSizeParam *farsounds.Param
+	dryParam      *farsounds.Param
+	dampParam     *farsounds.Param
+	widthParam    *farsounds.Param
 }
 
 func (freeverb *FreeVerbModule) setWet(wet float64) {
@@ -211,6 +226,16 @@ func (freeverb *FreeVerbModule) setMode(mode float64) {
 	freeverb.update()
 }
 
+// setParams sets wet, room size, dry, damp and width from their parameters
+func (freeverb *FreeVerbModule) setParams() {
+	freeverb.wet = freeverb.wetParam.Value * scalewet
+	freeverb.roomsize = (freeverb.roomSizeParam.Value * scaleroom) + offsetroom
+	freeverb.dry = freeverb.dryParam.Value * scaledry
+	freeverb.damp = freeverb.dampParam.Value * scaledamp
+	freeverb.width = freeverb.widthParam.Value
+	freeverb.update()
+}
+
 func (freeverb *FreeVerbModule) update() {
 	freeverb.wet1 = freeverb.wet * (freeverb.width/2.0 + 0.5)
 	freeverb.wet2 = freeverb.wet * ((1.0 - freeverb.width) / 2.0)
@@ -284,6 +309,20 @@ func NewFreeVerbModule(buflen int32, sr float64) *FreeVerbModule {
 	freeverb.setWidth(initialwidth)
 	freeverb.setMode(initialmode)
 
+	freeverb.wetParam = farsounds.NewParam(initialwet, freeverbSmoothing)
+	freeverb.roomSizeParam = farsounds.NewParam(initialroom, freeverbSmoothing)
+	freeverb.dryParam = farsounds.NewParam(initialdry, freeverbSmoothing)
+	freeverb.dampParam = farsounds.NewParam(initialdamp, freeverbSmoothing)
+	freeverb.widthParam = farsounds.NewParam(initialwidth, freeverbSmoothing)
+
+	freeverb.params = farsounds.ParamSet{
+		"wet":      freeverb.wetParam,
+		"roomSize": freeverb.roomSizeParam,
+		"dry":      freeverb.dryParam,
+		"damp":     freeverb.dampParam,
+		"width":    freeverb.widthParam,
+	}
+
 	return freeverb
 }
 
@@ -304,9 +343,20 @@ func (freeverb *FreeVerbModule) DSP(timestamp int64) {
 		inBuffer2 = freeverb.Inlets[1].Buffer
 	}
 
+	ramping := freeverb.params.Ramping()
+
 	for i := int32(0); i < buflen; i++ {
 		outL, outR, inputL, inputR, input := 0.0, 0.0, 0.0, 0.0, 0.0
 
+		if ramping {
+			freeverb.wetParam.Next()
+			freeverb.roomSizeParam.Next()
+			freeverb.dryParam.Next()
+			freeverb.dampParam.Next()
+			freeverb.widthParam.Next()
+			freeverb.setParams()
+		}
+
 		if inBuffer1 != nil {
 			inputL = inBuffer1[i]
 		}
@@ -334,24 +384,23 @@ func (freeverb *FreeVerbModule) DSP(timestamp int64) {
 	}
 }
 
-// Message received
+// FastForward advances the parameter ramps one buffer without processing
+// the filters
+func (freeverb *FreeVerbModule) FastForward(timestamp int64) {
+	if freeverb.params.Ramping() {
+		freeverb.params.Advance(int64(freeverb.BufferLength))
+		freeverb.setParams()
+	}
+}
+
+// Message received, wet, roomSize, dry, damp and width can be ramps, see
+// farsounds.Param. Numbers ramp over 50 ms, see freeverbSmoothing
 func (freeverb *FreeVerbModule) Message(message farsounds.Message) {
+	if freeverb.params.Message(message, freeverb.SampleRate) {
+		freeverb.setParams()
+	}
+
 	if valueMap, ok := message.(map[string]interface{}); ok {
-		if wet, ok := valueMap["wet"].(float64); ok {
-			freeverb.setWet(wet)
-		}
-		if roomSize, ok := valueMap["roomSize"].(float64); ok {
-			freeverb.setRoomSize(roomSize)
-		}
-		if dry, ok := valueMap["dry"].(float64); ok {
-			freeverb.setDry(dry)
-		}
-		if damp, ok := valueMap["damp"].(float64); ok {
-			freeverb.setDamp(damp)
-		}
-		if width, ok := valueMap["width"].(float64); ok {
-			freeverb.setWidth(width)
-		}
 		if mode, ok := valueMap["mode"].(float64); ok {
 			freeverb.setMode(mode)
 		}
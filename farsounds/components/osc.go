@@ -32,12 +32,20 @@ func (osc *Osc) Process(phaseMod float64) float64 {
 	Module based oscillator plus Processor interface methods
 */
 
+// Default smoothing of the osc module amplitude in seconds, frequency changes
+// are phase continuous and jump by default
+const oscAmplitudeSmoothing = 0.005
+
 // OscModule is an oscillator module
 type OscModule struct {
 	// Inherit from BaseModule
 	*farsounds.BaseModule
 	// Inherit from Osc
 	*Osc
+
+	// Smoothable parameters
+	frequency *farsounds.Param
+	amplitude *farsounds.Param
 }
 
 // NewOscModule creates a new osc module
@@ -46,6 +54,8 @@ func NewOscModule(table farsounds.WaveTable, phase float64, freq float64, amp fl
 	oscModule.BaseModule = farsounds.NewBaseModule(3, 1, buflen, sr)
 	oscModule.Parent = oscModule
 	oscModule.Osc = NewOsc(table, phase, freq/sr, amp)
+	oscModule.frequency = farsounds.NewParam(freq, 0.0)
+	oscModule.amplitude = farsounds.NewParam(amp, oscAmplitudeSmoothing)
 	return oscModule
 }
 
@@ -97,32 +107,46 @@ func (module *OscModule) DSP(timestamp int64) {
 		if fmodInput != nil {
 			inc := fmodInput[i] / sr
 			module.Inc = inc
+		} else if module.frequency.Ramping() {
+			module.Inc = module.frequency.Next() / sr
 		}
 
 		if ampInput != nil {
 			amp := ampInput[i]
 			module.Amplitude = amp
+		} else if module.amplitude.Ramping() {
+			module.Amplitude = module.amplitude.Next()
 		}
 
 		output[i] = module.Process(pmod)
 	}
 }
 
-// Message to module
+// FastForward advances the frequency and amplitude ramps one buffer, the phase
+// is kept
+func (module *OscModule) FastForward(timestamp int64) {
+	sr := module.GetSampleRate()
+	buflen := int64(module.GetBufferLength())
+
+	module.Inc = module.frequency.Advance(buflen) / sr
+	module.Amplitude = module.amplitude.Advance(buflen)
+}
+
+// Message to module, frequency and amplitude can be ramps, see farsounds.Param
 func (module *OscModule) Message(message farsounds.Message) {
 	sr := module.GetSampleRate()
 
 	if valueMap, ok := message.(map[string]interface{}); ok {
-		if frequency, ok := valueMap["frequency"].(float64); ok {
-			module.Inc = frequency / sr
+		if module.frequency.Set(valueMap["frequency"], sr) {
+			module.Inc = module.frequency.Value / sr
 		}
 
 		if phase, ok := valueMap["phase"].(float64); ok {
 			module.Phase = phase
 		}
 
-		if amplitude, ok := valueMap["amplitude"].(float64); ok {
-			module.Amplitude = amplitude
+		if module.amplitude.Set(valueMap["amplitude"], sr) {
+			module.Amplitude = module.amplitude.Value
 		}
 
 		if tableName, ok := valueMap["table"].(string); ok {
@@ -22,6 +22,9 @@ type PatchVoiceModule struct {
 	env        float64
 	attackInc  float64
 	releaseInc float64
+
+	// Sample offset of a pending note off in the next block, -1 if none
+	noteOffOffset int32
 }
 
 // PatchVoiceFactory factory
@@ -29,6 +32,7 @@ func PatchVoiceFactory(buflen int32, sr float64) farsounds.VoiceModule {
 	patchVoiceModule := new(PatchVoiceModule)
 	patchVoiceModule.BaseModule = farsounds.NewBaseModule(0, 2, buflen, sr)
 	patchVoiceModule.Parent = patchVoiceModule
+	patchVoiceModule.noteOffOffset = -1
 	return patchVoiceModule
 }
 
@@ -73,6 +77,11 @@ func (module *PatchVoiceModule) NoteOff() {
 	module.envState = patchVoiceEnvStateRelease
 }
 
+// NoteOffAt starts the release at a sample offset in the next block
+func (module *PatchVoiceModule) NoteOffAt(offset int32) {
+	module.noteOffOffset = offset
+}
+
 // NoteOn for patch voice module
 func (module *PatchVoiceModule) NoteOn(duration float64, sr float64, settings interface{}) {
 	settingsMap, ok := settings.(map[string]interface{})
@@ -82,11 +91,10 @@ func (module *PatchVoiceModule) NoteOn(duration float64, sr float64, settings in
 
 	attackDuration := 1.0
 	releaseDuration := 1.0
-	patchScriptPath := ""
 
-	if path, ok := settingsMap["patch"].(string); ok {
-		patchScriptPath = path
-	}
+	// Patch script path, reference to a patch script with arguments or patch
+	// settings, see farsounds.PatchFactory
+	patchSettings := settingsMap["patch"]
 
 	if attack, ok := settingsMap["attack"].(float64); ok {
 		attackDuration = attack
@@ -96,11 +104,11 @@ func (module *PatchVoiceModule) NoteOn(duration float64, sr float64, settings in
 		releaseDuration = release
 	}
 
-	if patchScriptPath == "" {
+	if patchSettings == nil || patchSettings == "" {
 		return
 	}
 
-	_patch, err := farsounds.PatchFactory(patchScriptPath, module.GetBufferLength(), sr)
+	_patch, err := farsounds.PatchFactory(patchSettings, module.GetBufferLength(), sr)
 	if err != nil {
 		return
 	}
@@ -114,6 +122,7 @@ func (module *PatchVoiceModule) NoteOn(duration float64, sr float64, settings in
 	// Create new patch and set envelope
 	module.patch = _patch.(*farsounds.Patch)
 	module.envState = patchVoiceEnvStateAttack
+	module.noteOffOffset = -1
 	module.env = 0.0
 	module.attackInc = 1.0 / (attackDuration * sr)
 	module.releaseInc = 1.0 / (releaseDuration * sr)
@@ -127,6 +136,11 @@ func (module *PatchVoiceModule) DSP(timestamp int64) {
 	module.patch.RequestDSP(timestamp)
 
 	for i := int32(0); i < buflen; i++ {
+		if i == module.noteOffOffset {
+			module.NoteOff()
+			module.noteOffOffset = -1
+		}
+
 		env := module.envProcess()
 
 		for j := 0; j < len(module.Outlets); j++ {
@@ -141,3 +155,38 @@ func (module *PatchVoiceModule) DSP(timestamp int64) {
 		}
 	}
 }
+
+// FastForward advances the envelope and fast forwards the patch
+func (module *PatchVoiceModule) FastForward(timestamp int64) {
+	if module.patch != nil {
+		module.patch.FastForward(timestamp)
+	}
+
+	if module.noteOffOffset >= 0 {
+		module.NoteOff()
+		module.noteOffOffset = -1
+	}
+
+	for i := int32(0); i < module.BufferLength; i++ {
+		module.envProcess()
+	}
+}
+
+// Update a sounding voice, "release" changes the release duration and
+// "messages" maps addresses in the patch to messages
+func (module *PatchVoiceModule) Update(settings interface{}) {
+	settingsMap, ok := settings.(map[string]interface{})
+	if !ok || module.patch == nil {
+		return
+	}
+
+	if release, ok := settingsMap["release"].(float64); ok && release > 0.0 {
+		module.releaseInc = 1.0 / (release * module.GetSampleRate())
+	}
+
+	if messages, ok := settingsMap["messages"].(map[string]interface{}); ok {
+		for address, message := range messages {
+			module.patch.SendMessage(farsounds.NewAddress(address), message)
+		}
+	}
+}
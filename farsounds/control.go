@@ -0,0 +1,105 @@
+package farsounds
+
+import "sync/atomic"
+
+/*
+	Control input
+*/
+
+// Default capacity of message queues
+const defaultMessageQueueCapacity = 1024
+
+// queuedMessage is a message waiting in a message queue
+type queuedMessage struct {
+	address   string
+	message   Message
+	timestamp int64
+}
+
+// MessageQueue is a lock-free single producer, single consumer queue that
+// hands messages from a control goroutine to the audio thread. The producer
+// pushes messages, the audio thread delivers them to a patch at the start of
+// a block. Messages are delivered in the order they are pushed, a message
+// with a timestamp in a later block holds back the messages pushed after it
+type MessageQueue struct {
+	// Read position, written by the consumer. The 64 bit fields come first
+	// for atomic access on 32 bit platforms
+	head uint64
+
+	// Write position, written by the producer
+	tail uint64
+
+	entries []queuedMessage
+	mask    uint64
+}
+
+// NewMessageQueue creates a queue that holds at least capacity messages
+func NewMessageQueue(capacity int) *MessageQueue {
+	size := 1
+	for size < capacity {
+		size <<= 1
+	}
+
+	return &MessageQueue{
+		entries: make([]queuedMessage, size),
+		mask:    uint64(size - 1),
+	}
+}
+
+// Push a message for the start of the next block, returns false if the queue
+// is full. Only one goroutine may push
+func (queue *MessageQueue) Push(address string, message Message) bool {
+	return queue.PushAt(address, message, -1)
+}
+
+// PushAt pushes a message that is due at a sample timestamp, it is delivered
+// at its offset within the block that contains the timestamp, late messages
+// at the start of the next block. Returns false if the queue is full. Only
+// one goroutine may push
+func (queue *MessageQueue) PushAt(address string, message Message, timestamp int64) bool {
+	tail := queue.tail
+
+	if tail-atomic.LoadUint64(&queue.head) == uint64(len(queue.entries)) {
+		return false
+	}
+
+	queue.entries[tail&queue.mask] = queuedMessage{
+		address:   address,
+		message:   message,
+		timestamp: timestamp,
+	}
+
+	atomic.StoreUint64(&queue.tail, tail+1)
+
+	return true
+}
+
+// Deliver sends the messages that are due in the block at timestamp to the
+// modules of patch, call it from the audio thread before the DSP of a block
+func (queue *MessageQueue) Deliver(patch Module, timestamp int64) {
+	end := timestamp + int64(patch.GetBufferLength())
+	head := queue.head
+	tail := atomic.LoadUint64(&queue.tail)
+
+	for head != tail {
+		entry := &queue.entries[head&queue.mask]
+		if entry.timestamp >= end {
+			break
+		}
+
+		message := entry.message
+		if entry.timestamp > timestamp {
+			message = &TimedMessage{
+				Message: message,
+				Offset:  int32(entry.timestamp - timestamp),
+			}
+		}
+
+		patch.SendMessage(NewAddress(entry.address), message)
+
+		// Release the message before the slot is handed back to the producer
+		*entry = queuedMessage{}
+		head++
+		atomic.StoreUint64(&queue.head, head)
+	}
+}
@@ -0,0 +1,145 @@
+package farsounds
+
+import (
+	"runtime"
+	"testing"
+)
+
+// receivedMessage is a message received by a recorder
+type receivedMessage struct {
+	message Message
+	offset  int32
+	timed   bool
+}
+
+// recorder is a module that keeps the messages it receives
+type recorder struct {
+	*BaseModule
+	received []receivedMessage
+}
+
+// newRecorder adds a recorder with identifier to patch
+func newRecorder(patch *Patch, identifier string) *recorder {
+	r := &recorder{BaseModule: NewBaseModule(0, 0, patch.GetBufferLength(), patch.GetSampleRate())}
+	r.Parent = r
+	r.SetIdentifier(identifier)
+	patch.AddModule(r)
+
+	return r
+}
+
+func (r *recorder) Message(message Message) {
+	r.received = append(r.received, receivedMessage{message: message})
+}
+
+func (r *recorder) MessageAt(message Message, offset int32) {
+	r.received = append(r.received, receivedMessage{message: message, offset: offset, timed: true})
+}
+
+// value returns the "value" of the i-th received message
+func (r *recorder) value(i int) float64 {
+	value, _ := r.received[i].message.(map[string]interface{})["value"].(float64)
+	return value
+}
+
+func TestMessageQueueOrder(t *testing.T) {
+	const numMessages = 2000
+
+	patch := NewPatch(0, 0, 64, 44100.0)
+	r := newRecorder(patch, "r")
+	queue := NewMessageQueue(16)
+
+	go func() {
+		for i := 0; i < numMessages; i++ {
+			for !queue.Push("r", map[string]interface{}{"value": float64(i)}) {
+				runtime.Gosched()
+			}
+		}
+	}()
+
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for timestamp := int64(0); len(r.received) < numMessages; timestamp += 64 {
+			queue.Deliver(patch, timestamp)
+			runtime.Gosched()
+		}
+	}()
+
+	<-done
+
+	for i := range r.received {
+		if r.received[i].timed || r.value(i) != float64(i) {
+			t.Fatalf("Message %d is %v", i, r.received[i])
+		}
+	}
+}
+
+func TestMessageQueueFull(t *testing.T) {
+	patch := NewPatch(0, 0, 64, 44100.0)
+	r := newRecorder(patch, "r")
+
+	// Capacity is rounded up to 4
+	queue := NewMessageQueue(3)
+
+	for i := 0; i < 4; i++ {
+		if !queue.Push("r", map[string]interface{}{"value": float64(i)}) {
+			t.Fatalf("Push %d failed", i)
+		}
+	}
+
+	if queue.Push("r", map[string]interface{}{"value": 4.0}) {
+		t.Fatal("Push to a full queue succeeded")
+	}
+
+	queue.Deliver(patch, 0)
+
+	if len(r.received) != 4 || r.value(3) != 3.0 {
+		t.Fatalf("Delivered %v", r.received)
+	}
+
+	if !queue.Push("r", map[string]interface{}{"value": 4.0}) {
+		t.Fatal("Push after delivery failed")
+	}
+}
+
+func TestMessageQueueTimestamps(t *testing.T) {
+	patch := NewPatch(0, 0, 64, 44100.0)
+	r := newRecorder(patch, "r")
+	queue := NewMessageQueue(16)
+
+	queue.Push("r", map[string]interface{}{"value": 0.0})
+	queue.PushAt("r", map[string]interface{}{"value": 1.0}, 10)
+	queue.PushAt("r", map[string]interface{}{"value": 2.0}, 70)
+
+	// Late, and held back by the message before it
+	queue.PushAt("r", map[string]interface{}{"value": 3.0}, 5)
+
+	queue.Deliver(patch, 0)
+
+	if len(r.received) != 2 {
+		t.Fatalf("First block delivered %v", r.received)
+	}
+
+	queue.Deliver(patch, 64)
+
+	expected := []receivedMessage{
+		{offset: 0, timed: false},
+		{offset: 10, timed: true},
+		{offset: 6, timed: true},
+		{offset: 0, timed: false},
+	}
+
+	if len(r.received) != len(expected) {
+		t.Fatalf("Delivered %v", r.received)
+	}
+
+	for i, e := range expected {
+		received := r.received[i]
+		if r.value(i) != float64(i) || received.offset != e.offset || received.timed != e.timed {
+			t.Errorf("Message %d is %v, expected offset %d timed %v", i, received, e.offset, e.timed)
+		}
+	}
+}
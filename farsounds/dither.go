@@ -0,0 +1,87 @@
+package farsounds
+
+import (
+	"math"
+	"math/rand"
+)
+
+/*
+	Dither
+*/
+
+// Error feedback filter coefficients for noise shaping (Wannamaker 3-tap),
+// pushes the dither noise up to frequencies where the ear is less sensitive
+var noiseShapingCoefficients = [3]float64{1.623, -0.982, 0.109}
+
+// ditherer quantizes interleaved samples to integer sample values with TPDF
+// dither and optional noise shaping. Quantized samples are returned as floats
+// that convert exactly to the integer sample values
+type ditherer struct {
+	// Scale from float to integer sample values
+	scale float64
+
+	// Apply noise shaping
+	shaped bool
+
+	// Number of interleaved channels
+	channels int
+
+	// Quantization error history per channel for noise shaping
+	errors [][3]float64
+
+	// Seeded random source, so renders are reproducible
+	rnd *rand.Rand
+}
+
+// newDitherer creates a ditherer for bits per sample, returns nil if no
+// dither should be applied
+func newDitherer(format *soundFormat, channels int) *ditherer {
+	if format.float || format.dither == "none" {
+		return nil
+	}
+
+	return &ditherer{
+		scale:    math.Pow(2.0, float64(format.bits-1)) - 1.0,
+		shaped:   format.dither == "shaped",
+		channels: channels,
+		errors:   make([][3]float64, channels),
+		rnd:      rand.New(rand.NewSource(1)),
+	}
+}
+
+// process dithers and quantizes samples in place, samples must start at
+// the first channel of a frame
+func (d *ditherer) process(samples []float64) {
+	scale := d.scale
+
+	for i, sample := range samples {
+		channel := i % d.channels
+		value := sample * scale
+
+		// Subtract filtered quantization error
+		if d.shaped {
+			e := &d.errors[channel]
+			value -= noiseShapingCoefficients[0]*e[0] + noiseShapingCoefficients[1]*e[1] + noiseShapingCoefficients[2]*e[2]
+		}
+
+		// Triangular noise of +/- 1 LSB
+		tpdf := d.rnd.Float64() - d.rnd.Float64()
+		quantized := math.Floor(value + tpdf + 0.5)
+
+		if d.shaped {
+			e := &d.errors[channel]
+			e[2] = e[1]
+			e[1] = e[0]
+			e[0] = quantized - value
+		}
+
+		// Clip to integer range
+		if quantized > scale {
+			quantized = scale
+		} else if quantized < -scale-1.0 {
+			quantized = -scale - 1.0
+		}
+
+		samples[i] = quantized / scale
+	}
+}
@@ -15,6 +15,7 @@ func init() {
 	fmt.Printf("- register module factories\n")
 	Registry.RegisterModuleFactory("patch", PatchFactory)
 	Registry.RegisterModuleFactory("poly", PolyVoiceModuleFactory)
+	Registry.RegisterModuleFactory("subblock", SubBlockPatchFactory)
 
 	fmt.Printf("- register wave tables\n\n")
 	Registry.RegisterWaveTable("sine", SineTable)
@@ -0,0 +1,160 @@
+package farsounds
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Sound file formats
+*/
+
+// SoundWriterOptions select the format of the final sound file
+type SoundWriterOptions struct {
+	// File format: "wav", "aiff", "flac" or "caf". If empty the format is
+	// inferred from the extension of the output file path, and if the path
+	// has no known extension aiff is used and the extension is appended. A
+	// format that differs from a known extension of the path is an error
+	FileFormat string `json:"format"`
+
+	// Sample format: "int16", "int24", "int32", "float32" or "float64".
+	// If empty float64 is used, or int24 for flac which has no float format
+	SampleFormat string `json:"sampleFormat"`
+
+	// Dither used when writing integer samples: "tpdf", "shaped" (tpdf with
+	// noise shaping) or "none". If empty tpdf is used for integer formats
+	Dither string `json:"dither"`
+
+	// Normalization: "peak" (sample peak), "truepeak" (4x oversampled peak),
+	// "loudness" (integrated loudness, EBU R128) or "none". If empty the
+	// sample peak is normalized
+	Normalize string `json:"normalize"`
+
+	// Normalization target in dBFS for peak and truepeak, default 0, or in
+	// LUFS for loudness, default -23
+	NormalizeTarget float64 `json:"normalizeTarget"`
+
+	// Where samples are kept until the normalization gain is known:
+	// "tempfile" (raw file in the temp directory), "memory" or "twopass" (the
+	// graph is rendered twice, first to measure, only for renders from a
+	// script or module factory). If empty tempfile is used for sound files
+	// and memory for streams
+	NormalizeStrategy string `json:"normalizeStrategy"`
+}
+
+// soundFormat is the resolved format of a sound file
+type soundFormat struct {
+	// File format
+	fileFormat string
+
+	// Sample format
+	sampleFormat string
+
+	// Bits per sample
+	bits int
+
+	// Samples are floating point
+	float bool
+
+	// Dither for integer samples
+	dither string
+}
+
+// fileFormatExtensions maps file formats to their default extension
+var fileFormatExtensions = map[string]string{
+	"wav":  ".wav",
+	"aiff": ".aiff",
+	"flac": ".flac",
+	"caf":  ".caf",
+}
+
+// extensionFileFormats maps file extensions to file formats
+var extensionFileFormats = map[string]string{
+	".wav":  "wav",
+	".wave": "wav",
+	".aiff": "aiff",
+	".aif":  "aiff",
+	".aifc": "aiff",
+	".flac": "flac",
+	".caf":  "caf",
+}
+
+// resolve the file path and format from the options, the file path gets an
+// extension if it has none
+func (options *SoundWriterOptions) resolve(filePath string) (string, *soundFormat, error) {
+	format := &soundFormat{
+		fileFormat:   strings.ToLower(options.FileFormat),
+		sampleFormat: strings.ToLower(options.SampleFormat),
+		dither:       strings.ToLower(options.Dither),
+	}
+
+	extFormat, hasExt := extensionFileFormats[strings.ToLower(filepath.Ext(filePath))]
+
+	if format.fileFormat != "" && hasExt && format.fileFormat != extFormat {
+		return "", nil, fmt.Errorf("File format %v does not match the extension of %v", options.FileFormat, filePath)
+	}
+
+	// Infer file format from extension
+	if format.fileFormat == "" {
+		if hasExt {
+			format.fileFormat = extFormat
+		} else {
+			format.fileFormat = "aiff"
+		}
+	}
+
+	ext, ok := fileFormatExtensions[format.fileFormat]
+	if !ok {
+		return "", nil, fmt.Errorf("Unknown file format %v", options.FileFormat)
+	}
+
+	if !hasExt {
+		filePath += ext
+	}
+
+	// Default sample format
+	if format.sampleFormat == "" {
+		if format.fileFormat == "flac" {
+			format.sampleFormat = "int24"
+		} else {
+			format.sampleFormat = "float64"
+		}
+	}
+
+	switch format.sampleFormat {
+	case "int16":
+		format.bits = 16
+	case "int24":
+		format.bits = 24
+	case "int32":
+		format.bits = 32
+	case "float32":
+		format.bits = 32
+		format.float = true
+	case "float64":
+		format.bits = 64
+		format.float = true
+	default:
+		return "", nil, fmt.Errorf("Unknown sample format %v", options.SampleFormat)
+	}
+
+	if format.fileFormat == "flac" && (format.float || format.bits > 24) {
+		return "", nil, fmt.Errorf("Sample format %v is not supported by flac", format.sampleFormat)
+	}
+
+	// Default dither
+	if format.float {
+		format.dither = "none"
+	} else if format.dither == "" {
+		format.dither = "tpdf"
+	}
+
+	switch format.dither {
+	case "none", "tpdf", "shaped":
+	default:
+		return "", nil, fmt.Errorf("Unknown dither %v", options.Dither)
+	}
+
+	return filePath, format, nil
+}
@@ -1,164 +1,277 @@
 package farsounds
 
 import (
-	"math"
+	"errors"
+	"fmt"
+	"io"
 	"os"
-
-	"github.com/mkb218/gosndfile/sndfile"
 )
 
 /*
    SoundWriter
 */
 
-// SoundWriter writes samples to soundfile and normalizes them
+// SoundWriter writes samples to a sound file or stream and normalizes them
 type SoundWriter struct {
-	// Temp output file
-	*sndfile.File
-
 	// Output format info
 	Channels   int32
 	Samplerate int32
 
-	// Set to true if we want a normalized output
-	// in that case first write to raw output file
-	// and in the end normalize to final output file
-	normalize bool
+	// Normalization mode, target and strategy
+	normalization *normalization
+
+	// Measures peaks and loudness of the written samples
+	meter *loudnessMeter
+
+	// Statistics, available after close
+	stats *SoundStats
+
+	// Keeps samples until the normalization gain is known, nil if samples
+	// are written straight to the output
+	store sampleStore
+
+	// Creates the final output
+	create func() (soundFileWriter, error)
 
-	// The temporary output file path
-	tempOutputFilePath string
+	// Removes the final output after an error, can be nil
+	remove func()
 
-	// The final output file path
-	finalOutputFilePath string
+	// The final output, created on the first write if samples are not
+	// stored, otherwise on close
+	output soundFileWriter
 
-	// The peak value used for normalization
-	peak float64
+	// The final output format
+	format *soundFormat
+
+	// Dither for integer output
+	dither *ditherer
+
+	// Buffer for gain and dither so written samples are not modified
+	exportBuffer []float64
 }
 
 // OpenSoundWriter creates a new opened sound writer
 func OpenSoundWriter(outputFilePath string, channels int32, samplerate int32, normalize bool) (*SoundWriter, error) {
-	info := sndfile.Info{}
-	info.Channels = channels
-	info.Format = sndfile.SF_FORMAT_RAW | sndfile.SF_FORMAT_DOUBLE
-	info.Samplerate = samplerate
-
-	tempOutputFilePath := outputFilePath + ".raw"
-	finalOutputFilePath := outputFilePath + ".aiff"
+	return OpenSoundWriterWithOptions(outputFilePath, channels, samplerate, normalize, nil)
+}
 
-	os.Remove(tempOutputFilePath)
-	os.Remove(finalOutputFilePath)
+// OpenSoundWriterWithOptions creates a new opened sound writer, options select
+// the format of the final output file and can be nil
+func OpenSoundWriterWithOptions(outputFilePath string, channels int32, samplerate int32, normalize bool, options *SoundWriterOptions) (*SoundWriter, error) {
+	if options == nil {
+		options = &SoundWriterOptions{}
+	}
 
-	tempFile, err := sndfile.Open(tempOutputFilePath, sndfile.ReadWrite, &info)
+	normalization, err := options.resolveNormalization(normalize, "tempfile")
 	if err != nil {
 		return nil, err
 	}
 
-	w := SoundWriter{}
-	w.Channels = channels
-	w.Samplerate = samplerate
-	w.normalize = normalize
-	w.tempOutputFilePath = tempOutputFilePath
-	w.finalOutputFilePath = finalOutputFilePath
-	w.File = tempFile
-
-	return &w, nil
+	return openSoundFileWriter(outputFilePath, channels, samplerate, normalization, options)
 }
 
-// WriteSamples write raw samples to temp output
-// keep track of peak value for normalization if needed
-func (w *SoundWriter) WriteSamples(in []float64) error {
-	_, err := w.WriteItems(in)
+// openSoundFileWriter creates a sound writer on a sound file
+func openSoundFileWriter(outputFilePath string, channels int32, samplerate int32, normalization *normalization, options *SoundWriterOptions) (*SoundWriter, error) {
+	finalOutputFilePath, format, err := options.resolve(outputFilePath)
+	if err != nil {
+		return nil, err
+	}
 
+	// Check the format before anything is rendered or removed
+	err = backend.Supports(format)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	os.Remove(finalOutputFilePath)
+
+	w := newSoundWriter(channels, samplerate, normalization, format)
+	w.create = func() (soundFileWriter, error) {
+		return backend.Create(finalOutputFilePath, channels, samplerate, format)
+	}
+	w.remove = func() {
+		os.Remove(finalOutputFilePath)
 	}
 
-	if w.normalize {
-		for _, sample := range in {
-			abs := math.Abs(sample)
-			if abs > w.peak {
-				w.peak = abs
+	if normalization.buffered() {
+		switch normalization.strategy {
+		case "tempfile":
+			w.store, err = newTempFileStore()
+			if err != nil {
+				return nil, err
 			}
+		case "memory":
+			w.store = &memoryStore{}
+		default:
+			return nil, errors.New("Two pass normalization needs a render source")
 		}
 	}
 
-	return nil
+	return w, nil
 }
 
-// Close the sound writer
-func (w *SoundWriter) Close() error {
-	err := w.normalizeAndExport()
+// NewSoundStreamWriter creates a sound writer that encodes a wav or aiff
+// stream to output, options can be nil. Normalized samples are kept in memory
+// until close, the stream is written without seeking so output can be a pipe
+func NewSoundStreamWriter(output io.Writer, channels int32, samplerate int32, normalize bool, options *SoundWriterOptions) (*SoundWriter, error) {
+	if options == nil {
+		options = &SoundWriterOptions{}
+	}
 
+	normalization, err := options.resolveNormalization(normalize, "memory")
 	if err != nil {
-		w.File.Close()
-		os.Remove(w.tempOutputFilePath)
-		return err
+		return nil, err
 	}
 
-	err = w.File.Close()
+	return newSoundStreamWriter(output, channels, samplerate, normalization, options)
+}
+
+// newSoundStreamWriter creates a sound writer on a stream
+func newSoundStreamWriter(output io.Writer, channels int32, samplerate int32, normalization *normalization, options *SoundWriterOptions) (*SoundWriter, error) {
+	_, format, err := options.resolve("")
 	if err != nil {
-		os.Remove(w.tempOutputFilePath)
-		return err
+		return nil, err
 	}
 
-	err = os.Remove(w.tempOutputFilePath)
+	if format.fileFormat != "wav" && format.fileFormat != "aiff" {
+		return nil, fmt.Errorf("File format %v can not be streamed", format.fileFormat)
+	}
 
-	return err
+	w := newSoundWriter(channels, samplerate, normalization, format)
+
+	if normalization.buffered() {
+		switch normalization.strategy {
+		case "memory":
+			store := &memoryStore{}
+			w.store = store
+
+			// All frames are known when the stream is created so the header
+			// is written with the correct sizes
+			w.create = func() (soundFileWriter, error) {
+				return newPCMWriter(output, channels, samplerate, format, int64(len(store.samples))/int64(channels))
+			}
+		case "tempfile":
+			return nil, errors.New("Streams can not be normalized with a temp file")
+		default:
+			return nil, errors.New("Two pass normalization needs a render source")
+		}
+	} else {
+		w.create = func() (soundFileWriter, error) {
+			return newPCMWriter(output, channels, samplerate, format, -1)
+		}
+	}
+
+	return w, nil
 }
 
-func (w *SoundWriter) normalizeAndExport() error {
-	_, err := w.Seek(0, sndfile.Set)
+// newSoundWriter creates a sound writer without output
+func newSoundWriter(channels int32, samplerate int32, normalization *normalization, format *soundFormat) *SoundWriter {
+	w := SoundWriter{}
+	w.Channels = channels
+	w.Samplerate = samplerate
+	w.normalization = normalization
+	w.meter = newLoudnessMeter(int(channels), float64(samplerate))
+	w.format = format
+	w.dither = newDitherer(format, int(channels))
 
-	if err != nil {
-		return err
+	return &w
+}
+
+// WriteSamples write samples to the store, or straight to the output if
+// no normalization is needed, and measure peaks and loudness. Samples must
+// contain whole frames
+func (w *SoundWriter) WriteSamples(in []float64) error {
+	w.meter.process(in)
+
+	if w.store != nil {
+		return w.store.write(in)
 	}
 
-	outputInfo := sndfile.Info{}
-	outputInfo.Channels = w.Channels
-	outputInfo.Format = sndfile.SF_FORMAT_AIFF | sndfile.SF_FORMAT_DOUBLE
-	outputInfo.Samplerate = w.Samplerate
+	if w.output == nil {
+		output, err := w.create()
+		if err != nil {
+			return err
+		}
 
-	outputFile, err := sndfile.Open(w.finalOutputFilePath, sndfile.Write, &outputInfo)
-	if err != nil {
-		return err
+		w.output = output
 	}
 
-	normalizeValue := 1.0
+	return w.export(in, w.normalization.gain)
+}
 
-	if w.normalize {
-		normalizeValue = 1.0 / w.peak
+// export applies gain and dither and writes samples to the output
+func (w *SoundWriter) export(in []float64, gain float64) error {
+	if len(w.exportBuffer) < len(in) {
+		w.exportBuffer = make([]float64, len(in))
 	}
 
-	sampleBlockSize := int64(2048)
-	samples := make([]float64, sampleBlockSize)
+	samples := w.exportBuffer[:len(in)]
 
-	for {
-		samplesToNormalize, err := w.ReadItems(samples[:])
+	for i, sample := range in {
+		samples[i] = sample * gain
+	}
+
+	// Reduce bit depth
+	if w.dither != nil {
+		w.dither.process(samples)
+	}
 
+	return w.output.WriteSamples(samples)
+}
+
+// Stats returns the statistics of the written samples and the applied gain,
+// nil until the sound writer is closed
+func (w *SoundWriter) Stats() *SoundStats {
+	return w.stats
+}
+
+// Close the sound writer, stored samples are normalized and exported to the
+// final output
+func (w *SoundWriter) Close() error {
+	w.stats = w.normalization.stats(w.meter)
+
+	err := w.normalizeAndExport()
+
+	if w.store != nil {
+		releaseErr := w.store.release()
+		if err == nil {
+			err = releaseErr
+		}
+	}
+
+	if err != nil && w.remove != nil {
+		w.remove()
+	}
+
+	return err
+}
+
+func (w *SoundWriter) normalizeAndExport() error {
+	// Create the output if nothing was written or samples were stored
+	if w.output == nil {
+		output, err := w.create()
 		if err != nil {
-			outputFile.Close()
-			os.Remove(w.finalOutputFilePath)
 			return err
 		}
 
-		// If we have no more samples to normalize then stop
-		if samplesToNormalize == 0 {
-			break
-		}
+		w.output = output
+	}
 
-		samplesSlice := samples[:samplesToNormalize]
+	if w.store != nil {
+		// Block size is a multiple of the number of channels so the ditherer
+		// always gets whole frames
+		err := w.store.replay(1024*int(w.Channels), func(samples []float64) error {
+			return w.export(samples, w.stats.Gain)
+		})
 
-		// Normalize samples
-		for i := int64(0); i < samplesToNormalize; i++ {
-			samplesSlice[i] *= normalizeValue
+		if err != nil {
+			w.output.Close()
+			return err
 		}
-
-		// Write samples to output
-		outputFile.WriteItems(samplesSlice)
 	}
 
 	// Close output
-	return outputFile.Close()
+	return w.output.Close()
 }
 
 /*
@@ -182,42 +295,44 @@ type SoundFileBuffer struct {
 
 // NewSoundFileBuffer load sound file from disk deinterleaved
 func NewSoundFileBuffer(filePath string) (*SoundFileBuffer, error) {
-	info := sndfile.Info{}
-
-	file, err := sndfile.Open(filePath, sndfile.Read, &info)
+	file, err := backend.Open(filePath)
 	if err != nil {
 		return nil, err
 	}
 
 	defer file.Close()
 
+	info := file.Info()
+
 	// Create one big buffer to hold all samples
-	fileBuffer := make([]float64, int64(info.Channels)*info.Frames)
+	fileBuffer := make([]float64, int64(info.channels)*info.frames)
 
-	// Create separate channels by splitting buffer into info.Channels parts
-	channels := make([][]float64, info.Channels)
-	for i := int32(0); i < info.Channels; i++ {
-		channels[i] = fileBuffer[int64(i)*info.Frames : int64(i+1)*info.Frames]
+	// Create separate channels by splitting buffer into info.channels parts
+	channels := make([][]float64, info.channels)
+	for i := int32(0); i < info.channels; i++ {
+		channels[i] = fileBuffer[int64(i)*info.frames : int64(i+1)*info.frames]
 	}
 
 	// Deinterleave in blocks
-	sampleBlockSize := int64(2048) * int64(info.Channels)
+	sampleBlockSize := int64(2048) * int64(info.channels)
 	samples := make([]float64, sampleBlockSize)
 	frameIndex := int64(0)
 
 	for {
-		framesRead, err := file.ReadFrames(samples)
+		samplesRead, err := file.ReadSamples(samples)
 		if err != nil {
 			return nil, err
 		}
 
-		if framesRead == 0 {
+		if samplesRead == 0 {
 			break
 		}
 
+		framesRead := int64(samplesRead) / int64(info.channels)
+
 		for i := int64(0); i < framesRead; i++ {
-			for j := int64(0); j < int64(info.Channels); j++ {
-				channels[j][frameIndex+i] = samples[i*int64(info.Channels)+j]
+			for j := int64(0); j < int64(info.channels); j++ {
+				channels[j][frameIndex+i] = samples[i*int64(info.channels)+j]
 			}
 		}
 
@@ -225,10 +340,10 @@ func NewSoundFileBuffer(filePath string) (*SoundFileBuffer, error) {
 	}
 
 	buffer := SoundFileBuffer{}
-	buffer.Duration = float64(info.Frames) / float64(info.Samplerate)
-	buffer.NumFrames = info.Frames
+	buffer.Duration = float64(info.frames) / float64(info.samplerate)
+	buffer.NumFrames = info.frames
 	buffer.Channels = channels
-	buffer.SampleRate = float64(info.Samplerate)
+	buffer.SampleRate = float64(info.samplerate)
 
 	return &buffer, nil
 }
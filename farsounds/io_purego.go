@@ -0,0 +1,35 @@
+//go:build !cgo || purego
+// +build !cgo purego
+
+package farsounds
+
+import "fmt"
+
+/*
+	Pure Go backend
+*/
+
+// Sound files are read and written with the pure Go wav and aiff codecs
+var backend soundFileBackend = pureGoBackend{}
+
+// pureGoBackend supports wav and aiff files with integer or float samples
+type pureGoBackend struct{}
+
+// Create a new sound file for writing
+func (pureGoBackend) Create(filePath string, channels int32, samplerate int32, format *soundFormat) (soundFileWriter, error) {
+	return createPCMFile(filePath, channels, samplerate, format)
+}
+
+// Open an existing sound file for reading
+func (pureGoBackend) Open(filePath string) (soundFileReader, error) {
+	return openPCMFile(filePath)
+}
+
+// Supports returns an error for formats other than wav and aiff
+func (pureGoBackend) Supports(format *soundFormat) error {
+	if format.fileFormat != "wav" && format.fileFormat != "aiff" {
+		return fmt.Errorf("File format %v is not supported by the pure Go backend", format.fileFormat)
+	}
+
+	return nil
+}
@@ -0,0 +1,124 @@
+//go:build cgo && !purego
+// +build cgo,!purego
+
+package farsounds
+
+import (
+	"fmt"
+
+	"github.com/mkb218/gosndfile/sndfile"
+)
+
+/*
+	libsndfile backend
+*/
+
+// Sound files are read and written with libsndfile
+var backend soundFileBackend = sndfileBackend{}
+
+// sndfileBackend uses libsndfile, supports every file format
+type sndfileBackend struct{}
+
+// sndfileSoundFile wraps a libsndfile file
+type sndfileSoundFile struct {
+	*sndfile.File
+	info soundFileInfo
+}
+
+// Create a new sound file for writing
+func (sndfileBackend) Create(filePath string, channels int32, samplerate int32, format *soundFormat) (soundFileWriter, error) {
+	outputFormat, err := sndfileFormat(format)
+	if err != nil {
+		return nil, err
+	}
+
+	info := sndfile.Info{}
+	info.Channels = channels
+	info.Format = outputFormat
+	info.Samplerate = samplerate
+
+	file, err := sndfile.Open(filePath, sndfile.Write, &info)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sndfileSoundFile{
+		File: file,
+		info: soundFileInfo{channels: channels, samplerate: samplerate},
+	}, nil
+}
+
+// Open an existing sound file for reading
+func (sndfileBackend) Open(filePath string) (soundFileReader, error) {
+	info := sndfile.Info{}
+
+	file, err := sndfile.Open(filePath, sndfile.Read, &info)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sndfileSoundFile{
+		File: file,
+		info: soundFileInfo{channels: info.Channels, samplerate: info.Samplerate, frames: info.Frames},
+	}, nil
+}
+
+// Info about the sound file
+func (f *sndfileSoundFile) Info() soundFileInfo {
+	return f.info
+}
+
+// WriteSamples writes interleaved samples
+func (f *sndfileSoundFile) WriteSamples(samples []float64) error {
+	_, err := f.WriteItems(samples)
+	return err
+}
+
+// ReadSamples reads interleaved samples
+func (f *sndfileSoundFile) ReadSamples(samples []float64) (int, error) {
+	n, err := f.ReadItems(samples)
+	return int(n), err
+}
+
+// Supports returns an error if libsndfile has no format for format
+func (sndfileBackend) Supports(format *soundFormat) error {
+	_, err := sndfileFormat(format)
+
+	return err
+}
+
+// sndfileFormat returns the libsndfile format for a sound format
+func sndfileFormat(format *soundFormat) (sndfile.Format, error) {
+	var fileFormat sndfile.Format
+	var sampleFormat sndfile.Format
+
+	switch format.fileFormat {
+	case "wav":
+		fileFormat = sndfile.SF_FORMAT_WAV
+	case "aiff":
+		fileFormat = sndfile.SF_FORMAT_AIFF
+	case "flac":
+		fileFormat = sndfile.SF_FORMAT_FLAC
+	case "caf":
+		fileFormat = sndfile.SF_FORMAT_CAF
+	default:
+		return 0, fmt.Errorf("Unsupported file format %v", format.fileFormat)
+	}
+
+	switch format.sampleFormat {
+	case "int16":
+		sampleFormat = sndfile.SF_FORMAT_PCM_16
+	case "int24":
+		sampleFormat = sndfile.SF_FORMAT_PCM_24
+	case "int32":
+		sampleFormat = sndfile.SF_FORMAT_PCM_32
+	case "float32":
+		sampleFormat = sndfile.SF_FORMAT_FLOAT
+	case "float64":
+		sampleFormat = sndfile.SF_FORMAT_DOUBLE
+	default:
+		return 0, fmt.Errorf("Unsupported sample format %v", format.sampleFormat)
+	}
+
+	return fileFormat | sampleFormat, nil
+}
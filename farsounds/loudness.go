@@ -0,0 +1,300 @@
+package farsounds
+
+import (
+	"math"
+)
+
+/*
+	Loudness meter
+*/
+
+// Oversampling factor and filter length of the true peak interpolator
+const (
+	truePeakOversampling = 4
+	truePeakTaps         = 48
+	truePeakPhaseTaps    = truePeakTaps / truePeakOversampling
+)
+
+// truePeakFilter holds the polyphase coefficients of the true peak
+// interpolator, a windowed sinc low pass at the original Nyquist frequency
+var truePeakFilter = func() [truePeakOversampling][truePeakPhaseTaps]float64 {
+	var phases [truePeakOversampling][truePeakPhaseTaps]float64
+
+	center := float64(truePeakTaps-1) / 2.0
+
+	for n := 0; n < truePeakTaps; n++ {
+		x := (float64(n) - center) / truePeakOversampling
+		sinc := 1.0
+		if x != 0 {
+			sinc = math.Sin(math.Pi*x) / (math.Pi * x)
+		}
+
+		// Blackman window
+		w := 0.42 - 0.5*math.Cos(2.0*math.Pi*float64(n)/float64(truePeakTaps-1)) +
+			0.08*math.Cos(4.0*math.Pi*float64(n)/float64(truePeakTaps-1))
+
+		phases[n%truePeakOversampling][n/truePeakOversampling] = sinc * w
+	}
+
+	// Unity gain for every phase
+	for p := range phases {
+		sum := 0.0
+		for _, c := range phases[p] {
+			sum += c
+		}
+
+		for k := range phases[p] {
+			phases[p][k] /= sum
+		}
+	}
+
+	return phases
+}()
+
+// biquad is a direct form II transposed biquad filter
+type biquad struct {
+	b0, b1, b2 float64
+	a1, a2     float64
+	z1, z2     float64
+}
+
+// process one sample
+func (f *biquad) process(x float64) float64 {
+	y := f.b0*x + f.z1
+	f.z1 = f.b1*x - f.a1*y + f.z2
+	f.z2 = f.b2*x - f.a2*y
+
+	return y
+}
+
+// kWeighting returns the two stage K-weighting filter of ITU-R BS.1770 for
+// a sample rate, a high shelf followed by a high pass
+func kWeighting(samplerate float64) [2]biquad {
+	// Stage 1, high shelf modelling the acoustic effect of the head
+	f0 := 1681.974450955533
+	g := 3.999843853973347
+	q := 0.7071752369554196
+
+	k := math.Tan(math.Pi * f0 / samplerate)
+	vh := math.Pow(10.0, g/20.0)
+	vb := math.Pow(vh, 0.4996667741545416)
+	a0 := 1.0 + k/q + k*k
+
+	shelf := biquad{
+		b0: (vh + vb*k/q + k*k) / a0,
+		b1: 2.0 * (k*k - vh) / a0,
+		b2: (vh - vb*k/q + k*k) / a0,
+		a1: 2.0 * (k*k - 1.0) / a0,
+		a2: (1.0 - k/q + k*k) / a0,
+	}
+
+	// Stage 2, RLB high pass
+	f0 = 38.13547087602444
+	q = 0.5003270373238773
+
+	k = math.Tan(math.Pi * f0 / samplerate)
+	a0 = 1.0 + k/q + k*k
+
+	highpass := biquad{
+		b0: 1.0,
+		b1: -2.0,
+		b2: 1.0,
+		a1: 2.0 * (k*k - 1.0) / a0,
+		a2: (1.0 - k/q + k*k) / a0,
+	}
+
+	return [2]biquad{shelf, highpass}
+}
+
+// loudnessChannelWeights returns the BS.1770 channel weights, 5.1 files
+// (L, R, C, LFE, Ls, Rs) skip the LFE and boost the surrounds, all other
+// layouts weigh every channel equally
+func loudnessChannelWeights(channels int) []float64 {
+	weights := make([]float64, channels)
+
+	for c := range weights {
+		weights[c] = 1.0
+	}
+
+	if channels == 6 {
+		weights[3] = 0.0
+		weights[4] = 1.41
+		weights[5] = 1.41
+	}
+
+	return weights
+}
+
+// loudnessMeter measures sample peak, true peak and integrated loudness
+// (EBU R128) of interleaved samples in a single pass
+type loudnessMeter struct {
+	// Number of interleaved channels
+	channels int
+
+	// Channel weights for loudness
+	weights []float64
+
+	// K-weighting filters per channel
+	filters [][2]biquad
+
+	// True peak interpolator history per channel, samples are stored twice
+	// so the most recent truePeakPhaseTaps samples are always contiguous
+	history  [][2 * truePeakPhaseTaps]float64
+	position int
+
+	// Number of frames in a 100ms gating step
+	stepFrames int64
+
+	// Weighted energy of the current step and frames in it
+	stepEnergy float64
+	stepCount  int64
+
+	// Weighted energy of every completed step
+	steps []float64
+
+	// Total number of frames measured
+	frames int64
+
+	// Sample peak
+	peak float64
+
+	// True peak
+	truePeak float64
+}
+
+// newLoudnessMeter creates a meter for interleaved samples
+func newLoudnessMeter(channels int, samplerate float64) *loudnessMeter {
+	m := &loudnessMeter{
+		channels:   channels,
+		weights:    loudnessChannelWeights(channels),
+		filters:    make([][2]biquad, channels),
+		history:    make([][2 * truePeakPhaseTaps]float64, channels),
+		stepFrames: int64(math.Round(samplerate * 0.1)),
+	}
+
+	for c := range m.filters {
+		m.filters[c] = kWeighting(samplerate)
+	}
+
+	return m
+}
+
+// process interleaved samples, samples must contain whole frames
+func (m *loudnessMeter) process(samples []float64) {
+	numFrames := len(samples) / m.channels
+
+	for i := 0; i < numFrames; i++ {
+		frame := samples[i*m.channels : (i+1)*m.channels]
+
+		// Advance the interpolator history
+		m.position--
+		if m.position < 0 {
+			m.position = truePeakPhaseTaps - 1
+		}
+
+		for c, sample := range frame {
+			abs := math.Abs(sample)
+			if abs > m.peak {
+				m.peak = abs
+			}
+
+			// True peak, newest sample first in history
+			h := &m.history[c]
+			h[m.position] = sample
+			h[m.position+truePeakPhaseTaps] = sample
+			recent := h[m.position : m.position+truePeakPhaseTaps]
+
+			for p := range truePeakFilter {
+				v := 0.0
+				for k, coef := range truePeakFilter[p] {
+					v += coef * recent[k]
+				}
+
+				v = math.Abs(v)
+				if v > m.truePeak {
+					m.truePeak = v
+				}
+			}
+
+			// K-weighted energy
+			if m.weights[c] != 0 {
+				f := &m.filters[c]
+				y := f[1].process(f[0].process(sample))
+				m.stepEnergy += m.weights[c] * y * y
+			}
+		}
+
+		m.stepCount++
+		if m.stepCount == m.stepFrames {
+			m.steps = append(m.steps, m.stepEnergy)
+			m.stepEnergy = 0.0
+			m.stepCount = 0
+		}
+	}
+
+	m.frames += int64(numFrames)
+}
+
+// truePeakValue returns the true peak, which is never below the sample peak
+func (m *loudnessMeter) truePeakValue() float64 {
+	return math.Max(m.peak, m.truePeak)
+}
+
+// integratedLoudness returns the gated integrated loudness in LUFS, or -Inf
+// if the measurement is shorter than one 400ms block or all blocks are gated
+func (m *loudnessMeter) integratedLoudness() float64 {
+	blockFrames := float64(4 * m.stepFrames)
+
+	// Mean square of 400ms blocks with 75% overlap
+	var blocks []float64
+	for j := 0; j+4 <= len(m.steps); j++ {
+		blocks = append(blocks, (m.steps[j]+m.steps[j+1]+m.steps[j+2]+m.steps[j+3])/blockFrames)
+	}
+
+	gatedMean := func(threshold float64) (float64, int) {
+		sum := 0.0
+		count := 0
+
+		for _, z := range blocks {
+			if energyToLUFS(z) > threshold {
+				sum += z
+				count++
+			}
+		}
+
+		if count == 0 {
+			return 0.0, 0
+		}
+
+		return sum / float64(count), count
+	}
+
+	// Absolute gate at -70 LUFS
+	mean, count := gatedMean(-70.0)
+	if count == 0 {
+		return math.Inf(-1)
+	}
+
+	// Relative gate 10 LU below the absolute gated loudness
+	mean, count = gatedMean(math.Max(-70.0, energyToLUFS(mean)-10.0))
+	if count == 0 {
+		return math.Inf(-1)
+	}
+
+	return energyToLUFS(mean)
+}
+
+// energyToLUFS converts weighted mean square energy to loudness
+func energyToLUFS(z float64) float64 {
+	return -0.691 + 10.0*math.Log10(z)
+}
+
+// amplitudeToDB converts linear amplitude to decibels, -Inf for silence
+func amplitudeToDB(amplitude float64) float64 {
+	return 20.0 * math.Log10(amplitude)
+}
+
+// dbToAmplitude converts decibels to linear amplitude
+func dbToAmplitude(db float64) float64 {
+	return math.Pow(10.0, db/20.0)
+}
@@ -1,6 +1,9 @@
 package farsounds
 
-import "strings"
+import (
+	"path"
+	"strings"
+)
 
 // Address is a container for the full path and path components
 type Address struct {
@@ -50,3 +53,141 @@ func (address *Address) Next() {
 		address.Components = address.Components[1:]
 	}
 }
+
+/*
+	Address patterns
+*/
+
+// Address components can be OSC style patterns. * matches any sequence of
+// characters, ? any single character, [1-4] a range or set of characters
+// ([!1-4] negates) and {a,b} one of the alternatives. An empty component, as
+// in //adsr, matches modules at any depth
+
+// isPattern returns true if the address component has pattern characters
+func isPattern(component string) bool {
+	return strings.ContainsAny(component, "*?[{")
+}
+
+// matchIdentifier returns true if identifier matches the address component
+func matchIdentifier(component string, identifier string) bool {
+	if !isPattern(component) {
+		return component == identifier
+	}
+
+	// Expand the first {a,b} alternation
+	if open := strings.IndexByte(component, '{'); open >= 0 {
+		end := strings.IndexByte(component[open:], '}')
+		if end < 0 {
+			return false
+		}
+
+		end += open
+		for _, alternative := range strings.Split(component[open+1:end], ",") {
+			if matchIdentifier(component[:open]+alternative+component[end+1:], identifier) {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	matched, err := path.Match(strings.Replace(component, "[!", "[^", -1), identifier)
+
+	return err == nil && matched
+}
+
+// next returns the address resolved to the next component, without changing
+// the address so it can be passed on to multiple modules
+func (address *Address) next() *Address {
+	return &Address{
+		Path:       address.Path,
+		Components: address.Components[1:],
+	}
+}
+
+/*
+	Timed messages
+*/
+
+// TimedMessage is a message that is due at a sample offset within the next
+// DSP block of the receiving module
+type TimedMessage struct {
+	Message Message
+	Offset  int32
+}
+
+// TimedMessageReceiver is implemented by modules that act on a message at a
+// sample offset within their next DSP block. Other modules receive the
+// message of a timed message at the start of the block
+type TimedMessageReceiver interface {
+	MessageAt(message Message, offset int32)
+}
+
+// deliverMessage delivers message to module, timed messages are delivered at
+// their offset if the module can receive them
+func deliverMessage(module Module, message Message) {
+	timed, ok := message.(*TimedMessage)
+	if !ok {
+		module.Message(message)
+		return
+	}
+
+	if receiver, ok := module.(TimedMessageReceiver); ok {
+		receiver.MessageAt(timed.Message, timed.Offset)
+	} else {
+		module.Message(timed.Message)
+	}
+}
+
+// timedEntry is a message in a timed message queue
+type timedEntry struct {
+	message Message
+	offset  int32
+}
+
+// TimedMessageQueue keeps messages until the sample they are due, modules
+// that implement TimedMessageReceiver push messages and deliver them from
+// their DSP loop
+type TimedMessageQueue struct {
+	entries []timedEntry
+}
+
+// Push a message due at offset, messages with the same offset are delivered
+// in the order they were pushed
+func (queue *TimedMessageQueue) Push(message Message, offset int32) {
+	i := len(queue.entries)
+	for i > 0 && queue.entries[i-1].offset > offset {
+		i--
+	}
+
+	queue.entries = append(queue.entries, timedEntry{})
+	copy(queue.entries[i+1:], queue.entries[i:])
+	queue.entries[i] = timedEntry{message: message, offset: offset}
+}
+
+// Deliver calls receive for all messages due at or before offset
+func (queue *TimedMessageQueue) Deliver(offset int32, receive func(message Message)) {
+	n := 0
+	for n < len(queue.entries) && queue.entries[n].offset <= offset {
+		receive(queue.entries[n].message)
+		n++
+	}
+
+	if n > 0 {
+		queue.entries = append(queue.entries[:0], queue.entries[n:]...)
+	}
+}
+
+// Flush calls receive for all queued messages
+func (queue *TimedMessageQueue) Flush(receive func(message Message)) {
+	for _, entry := range queue.entries {
+		receive(entry.message)
+	}
+
+	queue.entries = queue.entries[:0]
+}
+
+// Len returns the number of queued messages
+func (queue *TimedMessageQueue) Len() int {
+	return len(queue.entries)
+}
@@ -0,0 +1,394 @@
+package farsounds
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+/*
+	Live MIDI input
+*/
+
+// Controller number of the all notes off channel mode message
+const midiAllNotesOff = 123
+
+// MIDISource is a source of live MIDI channel messages
+type MIDISource interface {
+	// ReadMIDI blocks until the next channel message and returns its status
+	// and data bytes, io.EOF is returned after the source is closed
+	ReadMIDI() ([]byte, error)
+
+	// Close the source, a blocked ReadMIDI returns io.EOF
+	Close() error
+}
+
+// midiStreamSource parses channel messages from a raw MIDI byte stream
+type midiStreamSource struct {
+	reader *bufio.Reader
+	closer io.Closer
+
+	// Set by Close, read errors after close are reported as io.EOF
+	closed int32
+
+	// Unblocks a pending read on close, nil if the reader has no deadlines
+	deadline interface {
+		SetReadDeadline(t time.Time) error
+	}
+
+	// Running status
+	status byte
+}
+
+// NewMIDIStreamSource creates a MIDI source that parses a raw MIDI byte
+// stream, as read from a MIDI device, a pipe or a file. Running status is
+// supported, system exclusive and realtime messages are skipped. The reader
+// is closed with the source if it is an io.Closer. A read pending on close
+// only returns if the reader supports read deadlines or returns when it is
+// closed, as pipes, sockets and pollable devices do
+func NewMIDIStreamSource(r io.Reader) MIDISource {
+	source := &midiStreamSource{reader: bufio.NewReader(r)}
+
+	if closer, ok := r.(io.Closer); ok {
+		source.closer = closer
+	}
+
+	if deadline, ok := r.(interface {
+		SetReadDeadline(t time.Time) error
+	}); ok {
+		source.deadline = deadline
+	}
+
+	return source
+}
+
+// OpenMIDIDevice opens a raw MIDI device, for example /dev/snd/midiC1D0 on
+// Linux. Any file or named pipe with raw MIDI bytes can be opened as well.
+// Devices the Go runtime can not poll block a pending read until the next
+// byte arrives, so closing such a device waits for MIDI input
+func OpenMIDIDevice(path string) (MIDISource, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewMIDIStreamSource(file), nil
+}
+
+// ReadMIDI reads the next channel message from the stream
+func (source *midiStreamSource) ReadMIDI() ([]byte, error) {
+	var message []byte
+
+	for {
+		b, err := source.reader.ReadByte()
+		if err != nil {
+			if atomic.LoadInt32(&source.closed) != 0 {
+				return nil, io.EOF
+			}
+
+			return nil, err
+		}
+
+		switch {
+		case b >= 0xF8:
+			// Realtime messages can appear anywhere, even between data bytes
+			continue
+		case b >= 0xF0:
+			// System common and exclusive messages cancel running status,
+			// their data bytes are skipped until the next status byte
+			source.status = 0
+			message = nil
+			continue
+		case b&0x80 != 0:
+			source.status = b
+			message = []byte{b}
+			continue
+		case source.status == 0:
+			// Data byte without status
+			continue
+		}
+
+		if message == nil {
+			message = []byte{source.status}
+		}
+
+		message = append(message, b)
+
+		if len(message) == midiDataLength(source.status)+1 {
+			return message, nil
+		}
+	}
+}
+
+// Close the stream, a pending read is interrupted by a read deadline when
+// the reader supports it
+func (source *midiStreamSource) Close() error {
+	atomic.StoreInt32(&source.closed, 1)
+
+	if source.deadline != nil {
+		source.deadline.SetReadDeadline(time.Now())
+	}
+
+	if source.closer != nil {
+		return source.closer.Close()
+	}
+
+	return nil
+}
+
+// MIDILoopback is a virtual MIDI source, messages sent to it are read back
+// in order. Use it to drive a MIDIInput from code or to test routing
+type MIDILoopback struct {
+	messages  chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMIDILoopback creates a virtual MIDI source
+func NewMIDILoopback() *MIDILoopback {
+	return &MIDILoopback{
+		messages: make(chan []byte, 256),
+		closed:   make(chan struct{}),
+	}
+}
+
+// Send a channel message, blocks if the loopback is full
+func (loopback *MIDILoopback) Send(message ...byte) error {
+	if len(message) == 0 || message[0]&0x80 == 0 || message[0] >= 0xF0 {
+		return errors.New("Not a MIDI channel message")
+	}
+
+	if len(message) != midiDataLength(message[0])+1 {
+		return errors.New("Wrong number of MIDI data bytes")
+	}
+
+	select {
+	case <-loopback.closed:
+		return io.ErrClosedPipe
+	case loopback.messages <- append([]byte(nil), message...):
+		return nil
+	}
+}
+
+// ReadMIDI reads the next message sent to the loopback, messages sent before
+// Close are read before io.EOF
+func (loopback *MIDILoopback) ReadMIDI() ([]byte, error) {
+	select {
+	case message := <-loopback.messages:
+		return message, nil
+	default:
+	}
+
+	select {
+	case message := <-loopback.messages:
+		return message, nil
+	case <-loopback.closed:
+		return nil, io.EOF
+	}
+}
+
+// Close the loopback
+func (loopback *MIDILoopback) Close() error {
+	loopback.closeOnce.Do(func() {
+		close(loopback.closed)
+	})
+
+	return nil
+}
+
+// MIDIControllerRoute maps a MIDI controller to a module parameter
+type MIDIControllerRoute struct {
+	// Channel from 1 to 16, nil matches every channel
+	Channel *int
+
+	// Controller number
+	Controller int
+
+	// Address of the module
+	Address string
+
+	// Parameter is the message key that gets the controller value
+	Parameter string
+
+	// Range the controller value 0-127 is scaled to, 0-1 if both are zero
+	Min float64
+	Max float64
+}
+
+// value scales a controller value to the range of the route
+func (route *MIDIControllerRoute) value(value int) float64 {
+	min, max := route.Min, route.Max
+	if min == 0.0 && max == 0.0 {
+		max = 1.0
+	}
+
+	return min + (max-min)*float64(value)/127.0
+}
+
+// MIDIInput reads a MIDI source and sends its notes and controllers to the
+// modules of a patch. Notes are sent to the addresses of matching note routes
+// as open ended {"noteOn", "settings"} and {"noteOff"} messages, the messages
+// a PolyVoiceModule understands. The key of a note is note + 128 * (channel -
+// 1). Controllers are sent as {parameter: value} messages, controller 123
+// sends {"allNotesOff"} to the note routes of the channel. Messages are read
+// on a separate goroutine and delivered on the audio thread by Dispatch
+type MIDIInput struct {
+	// Note routes, the track of a route is ignored
+	Notes []*MIDIRoute
+
+	// Controller routes
+	Controllers []*MIDIControllerRoute
+
+	source MIDISource
+
+	// Messages waiting for the next Dispatch
+	queue *MessageQueue
+
+	// Reader goroutine and the error that stopped it
+	done  chan struct{}
+	mutex sync.Mutex
+	err   error
+}
+
+// NewMIDIInput creates a MIDI input for source
+func NewMIDIInput(source MIDISource, notes []*MIDIRoute, controllers []*MIDIControllerRoute) *MIDIInput {
+	return &MIDIInput{
+		Notes:       notes,
+		Controllers: controllers,
+		source:      source,
+		queue:       NewMessageQueue(defaultMessageQueueCapacity),
+	}
+}
+
+// Start reading the source on a separate goroutine
+func (input *MIDIInput) Start() {
+	input.done = make(chan struct{})
+
+	go func() {
+		defer close(input.done)
+
+		for {
+			message, err := input.source.ReadMIDI()
+			if err != nil {
+				if err != io.EOF {
+					input.mutex.Lock()
+					input.err = err
+					input.mutex.Unlock()
+				}
+
+				return
+			}
+
+			input.Handle(message)
+		}
+	}()
+}
+
+// Handle translates a channel message to messages for the next Dispatch.
+// Only one goroutine may call Handle, after Start that is the reader. Messages
+// are dropped if the queue is full
+func (input *MIDIInput) Handle(message []byte) {
+	if len(message) < 2 {
+		return
+	}
+
+	kind := message[0] & 0xF0
+	channel := int(message[0]&0x0F) + 1
+
+	var deliveries []*ScoreDelivery
+
+	switch kind {
+	case midiNoteOn, midiNoteOff:
+		if len(message) < 3 {
+			return
+		}
+
+		note := int(message[1])
+		velocity := int(message[2])
+		key := float64(note + 128*(channel-1))
+
+		for _, route := range input.Notes {
+			if route.Channel != nil && *route.Channel != channel {
+				continue
+			}
+
+			var noteMessage map[string]interface{}
+
+			if kind == midiNoteOn && velocity > 0 {
+				noteMessage = map[string]interface{}{
+					"noteOn":   key,
+					"settings": midiNoteSettings(route, 0, channel, note, velocity),
+				}
+			} else {
+				noteMessage = map[string]interface{}{"noteOff": key}
+			}
+
+			deliveries = append(deliveries, &ScoreDelivery{
+				Address: route.Address,
+				Message: noteMessage,
+			})
+		}
+	case midiControlChange:
+		if len(message) < 3 {
+			return
+		}
+
+		if message[1] == midiAllNotesOff {
+			for _, route := range input.Notes {
+				if route.Channel == nil || *route.Channel == channel {
+					deliveries = append(deliveries, &ScoreDelivery{
+						Address: route.Address,
+						Message: map[string]interface{}{"allNotesOff": true},
+					})
+				}
+			}
+		}
+
+		for _, route := range input.Controllers {
+			if route.Controller != int(message[1]) || (route.Channel != nil && *route.Channel != channel) {
+				continue
+			}
+
+			deliveries = append(deliveries, &ScoreDelivery{
+				Address: route.Address,
+				Message: map[string]interface{}{
+					route.Parameter: route.value(int(message[2])),
+				},
+			})
+		}
+	}
+
+	for _, delivery := range deliveries {
+		input.queue.Push(delivery.Address, delivery.Message)
+	}
+}
+
+// Dispatch sends the pending messages to the modules of patch, call it from
+// the audio thread before the DSP of the block at timestamp
+func (input *MIDIInput) Dispatch(patch Module, timestamp int64) {
+	input.queue.Deliver(patch, timestamp)
+}
+
+// Close the source and wait for the reader goroutine to finish, which is
+// after the pending read of the source returns, see OpenMIDIDevice
+func (input *MIDIInput) Close() error {
+	err := input.source.Close()
+
+	if input.done != nil {
+		<-input.done
+	}
+
+	return err
+}
+
+// Err returns the error that stopped reading the source, if any
+func (input *MIDIInput) Err() error {
+	input.mutex.Lock()
+	defer input.mutex.Unlock()
+
+	return input.err
+}
@@ -0,0 +1,186 @@
+package farsounds
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestMIDIStreamSource(t *testing.T) {
+	stream := []byte{
+		// Note on with a clock and active sensing between the data bytes
+		0x90, 0x3C, 0xF8, 0x64, 0xFE,
+		// Running status, velocity 0 note off
+		0x3E, 0x00,
+		// System exclusive cancels running status, the stray data byte is
+		// dropped
+		0xF0, 0x7E, 0x01, 0xF7, 0x40,
+		// Control change and program change
+		0xB1, 0x07, 0xF8, 0x7F,
+		0xC2, 0x05,
+	}
+
+	source := NewMIDIStreamSource(bytes.NewReader(stream))
+
+	expected := [][]byte{
+		{0x90, 0x3C, 0x64},
+		{0x90, 0x3E, 0x00},
+		{0xB1, 0x07, 0x7F},
+		{0xC2, 0x05},
+	}
+
+	for _, e := range expected {
+		message, err := source.ReadMIDI()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(message, e) {
+			t.Fatalf("Read % X, expected % X", message, e)
+		}
+	}
+
+	if _, err := source.ReadMIDI(); err != io.EOF {
+		t.Fatalf("Read after the end returned %v", err)
+	}
+}
+
+func TestMIDIInputRouting(t *testing.T) {
+	channel2 := 2
+	channel1 := 1
+
+	loopback := NewMIDILoopback()
+
+	input := NewMIDIInput(loopback, []*MIDIRoute{
+		{Address: "poly"},
+		{Address: "bass", Channel: &channel2},
+	}, []*MIDIControllerRoute{
+		{Controller: 7, Address: "osc1", Parameter: "amplitude"},
+		{Controller: 74, Channel: &channel1, Address: "filter", Parameter: "cutoff", Min: 100.0, Max: 2100.0},
+	})
+
+	input.Start()
+
+	sends := [][]byte{
+		{0x90, 60, 127},
+		{0x91, 60, 127},
+		{0x90, 60, 0},
+		{0xB1, midiAllNotesOff, 0},
+		{0xB0, midiAllNotesOff, 0},
+		{0xB0, 7, 127},
+		{0xB3, 7, 0},
+		{0xB0, 74, 0},
+		{0xB0, 74, 127},
+		{0xB1, 74, 127},
+	}
+
+	for _, send := range sends {
+		if err := loopback.Send(send...); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := loopback.Send(0x90, 60); err == nil {
+		t.Error("Message with a missing data byte was sent")
+	}
+
+	// Messages sent before close are read before the reader stops
+	if err := input.Close(); err != nil || input.Err() != nil {
+		t.Fatal(err, input.Err())
+	}
+
+	patch := NewPatch(0, 0, 64, 44100.0)
+	poly := newRecorder(patch, "poly")
+	bass := newRecorder(patch, "bass")
+	osc := newRecorder(patch, "osc1")
+	filter := newRecorder(patch, "filter")
+
+	input.Dispatch(patch, 0)
+
+	messages := func(r *recorder) []Message {
+		var received []Message
+		for _, m := range r.received {
+			received = append(received, m.message)
+		}
+
+		return received
+	}
+
+	noteOn := func(key float64, channel int) map[string]interface{} {
+		return map[string]interface{}{
+			"noteOn": key,
+			"settings": map[string]interface{}{
+				"note":      60.0,
+				"frequency": midiNoteFrequency(60),
+				"velocity":  1.0,
+				"amplitude": 1.0,
+				"channel":   float64(channel),
+				"track":     0.0,
+			},
+		}
+	}
+
+	allNotesOff := map[string]interface{}{"allNotesOff": true}
+
+	expected := map[*recorder][]Message{
+		poly: {
+			noteOn(60.0, 1),
+			noteOn(188.0, 2),
+			map[string]interface{}{"noteOff": 60.0},
+			allNotesOff,
+			allNotesOff,
+		},
+		bass: {
+			noteOn(188.0, 2),
+			allNotesOff,
+		},
+		osc: {
+			map[string]interface{}{"amplitude": 1.0},
+			map[string]interface{}{"amplitude": 0.0},
+		},
+		filter: {
+			map[string]interface{}{"cutoff": 100.0},
+			map[string]interface{}{"cutoff": 2100.0},
+		},
+	}
+
+	for r, e := range expected {
+		if received := messages(r); !reflect.DeepEqual(received, e) {
+			t.Errorf("%v received %v, expected %v", r.GetIdentifier(), received, e)
+		}
+	}
+}
+
+func TestMIDIInputCloseInterruptsRead(t *testing.T) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer writer.Close()
+
+	input := NewMIDIInput(NewMIDIStreamSource(reader), nil, nil)
+	input.Start()
+
+	// Let the reader block on the pipe
+	writer.Write([]byte{0x90, 0x3C})
+	time.Sleep(10 * time.Millisecond)
+
+	closed := make(chan error)
+
+	go func() {
+		closed <- input.Close()
+	}()
+
+	select {
+	case err := <-closed:
+		if err != nil || input.Err() != nil {
+			t.Fatal(err, input.Err())
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Close did not interrupt the pending read")
+	}
+}
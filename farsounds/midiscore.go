@@ -0,0 +1,219 @@
+package farsounds
+
+import (
+	"container/list"
+	"fmt"
+	"math"
+	"sort"
+)
+
+/*
+	MIDI file scores
+*/
+
+// MIDIRoute sends the notes of a MIDI track and channel to a module address
+type MIDIRoute struct {
+	// Track index, zero based, nil matches every track
+	Track *int
+
+	// Channel from 1 to 16, nil matches every channel
+	Channel *int
+
+	// Address of the module that gets the note messages
+	Address string
+
+	// Settings added to the settings of every note message
+	Settings map[string]interface{}
+}
+
+// matches returns true if the route matches track and channel (1 to 16)
+func (route *MIDIRoute) matches(track int, channel int) bool {
+	return (route.Track == nil || *route.Track == track) &&
+		(route.Channel == nil || *route.Channel == channel)
+}
+
+// DefaultMIDIRoutes sends the notes of channel N to the module with
+// identifier channelN, for every track
+func DefaultMIDIRoutes() []*MIDIRoute {
+	routes := make([]*MIDIRoute, 16)
+
+	for i := range routes {
+		channel := i + 1
+		routes[i] = &MIDIRoute{
+			Channel: &channel,
+			Address: fmt.Sprintf("channel%d", channel),
+		}
+	}
+
+	return routes
+}
+
+// midiNoteFrequency returns the frequency of a MIDI note number
+func midiNoteFrequency(note int) float64 {
+	return 440.0 * math.Pow(2.0, float64(note-69)/12.0)
+}
+
+// midiNoteSettings returns the voice settings of a note, velocity is scaled
+// to 0-1 and also used as amplitude. Settings of the route are added
+func midiNoteSettings(route *MIDIRoute, track int, channel int, note int, velocity int) map[string]interface{} {
+	settings := map[string]interface{}{
+		"note":      float64(note),
+		"frequency": midiNoteFrequency(note),
+		"velocity":  float64(velocity) / 127.0,
+		"amplitude": float64(velocity) / 127.0,
+		"channel":   float64(channel),
+		"track":     float64(track),
+	}
+
+	for key, value := range route.Settings {
+		settings[key] = value
+	}
+
+	return settings
+}
+
+// midiNote is a paired note on and note off
+type midiNote struct {
+	track    int
+	channel  int
+	note     int
+	velocity int
+	start    int64
+	end      int64
+}
+
+// LoadMIDIScore loads a Standard MIDI File as a score. Every note is sent as a
+// {"duration", "settings"} message, the message PolyVoiceModule expects, to
+// the addresses of the routes that match its track and channel. Settings hold
+// note, frequency, velocity, amplitude, channel and track. Tempo meta events
+// become the tempo map of the score, durations follow the tempo map as loaded
+func LoadMIDIScore(filePath string, routes []*MIDIRoute) (*Score, error) {
+	midi, err := readMIDIFile(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	// Tempo map in quarter note beats, MIDI files default to 120 bpm
+	var tempo *TempoMap
+
+	if midi.ticksPerQuarter > 0 {
+		tempo = NewTempoMap(defaultBPM)
+
+		for _, events := range midi.tracks {
+			for _, event := range events {
+				if event.status == 0xFF && event.metaType == midiMetaTempo && len(event.data) == 3 {
+					microsPerQuarter := int(event.data[0])<<16 | int(event.data[1])<<8 | int(event.data[2])
+					if microsPerQuarter > 0 {
+						tempo.Add(TempoPoint{
+							Beat: float64(event.tick) / float64(midi.ticksPerQuarter),
+							BPM:  60000000.0 / float64(microsPerQuarter),
+						})
+					}
+				}
+			}
+		}
+	}
+
+	// Seconds of a tick
+	seconds := func(tick int64) float64 {
+		if tempo == nil {
+			return float64(tick) / midi.ticksPerSecond
+		}
+
+		return tempo.Seconds(float64(tick) / float64(midi.ticksPerQuarter))
+	}
+
+	// Pair note ons with note offs, overlapping notes of the same pitch are
+	// ended first in first out
+	var notes []*midiNote
+
+	for track, events := range midi.tracks {
+		pending := make(map[[2]int][]*midiNote)
+		endTick := int64(0)
+
+		for _, event := range events {
+			endTick = event.tick
+
+			if event.status == 0xFF {
+				continue
+			}
+
+			kind := event.status & 0xF0
+			channel := int(event.status&0x0F) + 1
+
+			if kind != midiNoteOn && kind != midiNoteOff {
+				continue
+			}
+
+			key := [2]int{channel, int(event.data[0])}
+			velocity := int(event.data[1])
+
+			if kind == midiNoteOn && velocity > 0 {
+				note := &midiNote{
+					track:    track,
+					channel:  channel,
+					note:     int(event.data[0]),
+					velocity: velocity,
+					start:    event.tick,
+				}
+
+				pending[key] = append(pending[key], note)
+				notes = append(notes, note)
+			} else if len(pending[key]) > 0 {
+				pending[key][0].end = event.tick
+				pending[key] = pending[key][1:]
+			}
+		}
+
+		// Notes that are never turned off end with the track
+		for _, unfinished := range pending {
+			for _, note := range unfinished {
+				note.end = endTick
+			}
+		}
+	}
+
+	sort.SliceStable(notes, func(i, j int) bool {
+		return notes[i].start < notes[j].start
+	})
+
+	score := Score{
+		Events: list.New(),
+		Tempo:  tempo,
+	}
+
+	for _, note := range notes {
+		action := ScoreSendAction{}
+
+		for _, route := range routes {
+			if !route.matches(note.track, note.channel) {
+				continue
+			}
+
+			action.Deliveries = append(action.Deliveries, &ScoreDelivery{
+				Address: route.Address,
+				Message: map[string]interface{}{
+					"duration": seconds(note.end) - seconds(note.start),
+					"settings": midiNoteSettings(route, note.track, note.channel, note.note, note.velocity),
+				},
+			})
+		}
+
+		if len(action.Deliveries) == 0 {
+			continue
+		}
+
+		event := ScoreEvent{
+			On:     seconds(note.start),
+			Action: &action,
+		}
+
+		if tempo != nil {
+			event.Beat = float64(note.start) / float64(midi.ticksPerQuarter)
+		}
+
+		score.Events.PushBack(&event)
+	}
+
+	return &score, nil
+}
@@ -2,7 +2,7 @@ package farsounds
 
 import (
 	"container/list"
-	"errors"
+	"io"
 )
 
 // Buffer is a alias for a float64 slice
@@ -26,6 +26,14 @@ type Connection struct {
 
 	// The index of the inlet or outlet of the connected module
 	Index int
+
+	// Feedback connections read the output of the previous buffer, they are
+	// used to close a cycle in the module graph
+	Feedback bool
+
+	// Output of the previous buffer for a feedback connection, only set on
+	// the inlet side of the connection
+	Buffer Buffer
 }
 
 // Module interface
@@ -51,6 +59,10 @@ type Module interface {
 	// Connect to another module
 	Connect(out int, otherModule Module, in int)
 
+	// Connect to another module with a feedback connection, the other module
+	// reads the output of the previous buffer
+	ConnectFeedback(out int, otherModule Module, in int)
+
 	// Disconnect from another module
 	Disconnect(out int, otherModule Module, in int)
 
@@ -81,6 +93,16 @@ type Module interface {
 
 	// Render to file
 	Render(filePath string, numSeconds float64) error
+
+	// Render to a wav or aiff stream
+	RenderToWriter(writer io.Writer, numSeconds float64) error
+}
+
+// FastForwarder is implemented by modules that can advance one buffer without
+// generating samples, renders use it to seek quickly to the start of a range
+type FastForwarder interface {
+	// Advance state for the buffer at timestamp without performing DSP
+	FastForward(timestamp int64)
 }
 
 // BaseModule is the base module that implements all module interface methods
@@ -108,6 +130,10 @@ type BaseModule struct {
 
 	// BufferLength for this module
 	BufferLength int32
+
+	// Connection generation of the patch the module is in, nil outside a
+	// patch
+	generation *uint64
 }
 
 // NewBaseModule creates a new basic module
@@ -177,6 +203,15 @@ func (baseModule *BaseModule) RequestDSP(timestamp int64) {
 			// Get connection
 			conn := e.Value.(*Connection)
 
+			// Feedback connections read the previous output and are not pulled
+			if conn.Feedback {
+				for i, v := range conn.Buffer {
+					inBuffer[i] += v
+				}
+
+				continue
+			}
+
 			// Call request DSP of connected module
 			conn.To.RequestDSP(timestamp)
 
@@ -243,6 +278,16 @@ func (baseModule *BaseModule) IsConnected(out int, otherModule Module, in int) b
 
 // Connect two modules
 func (baseModule *BaseModule) Connect(out int, otherModule Module, in int) {
+	baseModule.connect(out, otherModule, in, false)
+}
+
+// ConnectFeedback connects two modules with a feedback connection
+func (baseModule *BaseModule) ConnectFeedback(out int, otherModule Module, in int) {
+	baseModule.connect(out, otherModule, in, true)
+}
+
+// connect two modules, optionally with a feedback connection
+func (baseModule *BaseModule) connect(out int, otherModule Module, in int, feedback bool) {
 	module := baseModule.Parent
 
 	outlets := module.GetOutlets()
@@ -258,13 +303,24 @@ func (baseModule *BaseModule) Connect(out int, otherModule Module, in int) {
 
 	outConn.To = otherModule
 	outConn.Index = in
+	outConn.Feedback = feedback
 
 	inConn.To = module
 	inConn.Index = out
+	inConn.Feedback = feedback
+
+	// The inlet side keeps a copy of the previous output
+	if feedback {
+		inConn.Buffer = make(Buffer, len(outlets[out].Buffer))
+	}
 
 	// Add output to outlet and input to inlet
 	_ = outlets[out].Connections.PushBack(outConn)
 	_ = inlets[in].Connections.PushBack(inConn)
+
+	// Invalidate compiled schedules
+	graphChanged(module)
+	graphChanged(otherModule)
 }
 
 // Disconnect two modules
@@ -297,6 +353,10 @@ func (baseModule *BaseModule) Disconnect(out int, otherModule Module, in int) {
 			break
 		}
 	}
+
+	// Invalidate compiled schedules
+	graphChanged(module)
+	graphChanged(otherModule)
 }
 
 // GetBufferLength for this module
@@ -327,53 +387,11 @@ func (baseModule *BaseModule) Message(message Message) {}
 
 // Render module output to sound file
 func (baseModule *BaseModule) Render(filePath string, numSeconds float64) error {
-	self := baseModule.Parent
-	outlets := self.GetOutlets()
-	sr := self.GetSampleRate()
-	buflen := self.GetBufferLength()
-	numChannels := int32(len(outlets))
-
-	// Sanity check on numChannels
-	if numChannels < 1 || numChannels > 2 {
-		return errors.New("Module must have one or two outputs")
-	}
-
-	// Open sound writer
-	writer, err := OpenSoundWriter(filePath, numChannels, int32(sr), true)
-	if err != nil {
-		return err
-	}
-
-	// Always clean up writer
-	defer writer.Close()
-
-	// Prepare DSP loop
-	timestamp := int64(0)
-	numCycles := int64(((numSeconds * sr) / float64(buflen)) + 0.5)
-	sampleBuffer := make([]float64, numChannels*buflen)
-
-	// Generate samples for N cycles
-	for i := int64(0); i < numCycles; i++ {
-		self.PrepareDSP()
-		self.RequestDSP(timestamp)
-
-		// Interleave channels
-		for j := int32(0); j < buflen; j++ {
-			for c := int32(0); c < numChannels; c++ {
-				sampleBuffer[j*numChannels+c] = outlets[c].Buffer[j]
-			}
-		}
-
-		// Write samples
-		err = writer.WriteSamples(sampleBuffer)
-		if err != nil {
-			return err
-		}
-
-		// Increase timestamp
-		timestamp += int64(buflen)
-	}
+	return RenderModule(baseModule.Parent, filePath, numSeconds, nil)
+}
 
-	// No errors
-	return nil
+// RenderToWriter renders module output to a wav or aiff stream
+func (baseModule *BaseModule) RenderToWriter(writer io.Writer, numSeconds float64) error {
+	_, err := RenderModuleToWriter(baseModule.Parent, writer, numSeconds, nil)
+	return err
 }
@@ -0,0 +1,150 @@
+package farsounds
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+/*
+	Normalization
+*/
+
+// Default integrated loudness target in LUFS (EBU R128)
+const defaultLoudnessTarget = -23.0
+
+// SoundStats are the statistics measured by a SoundWriter, peaks and loudness
+// are measured before normalization. Decibel values are -Inf for silence
+type SoundStats struct {
+	// Number of frames written
+	Frames int64
+
+	// Sample peak, linear and in dBFS
+	Peak   float64
+	PeakDB float64
+
+	// True peak (4x oversampled), linear and in dBFS
+	TruePeak   float64
+	TruePeakDB float64
+
+	// Integrated loudness in LUFS, -Inf if the output is shorter than 400ms
+	// or too quiet to pass the absolute gate
+	Loudness float64
+
+	// Gain applied to the output, linear and in dB
+	Gain   float64
+	GainDB float64
+
+	// Output is digital silence, no gain was applied
+	Silent bool
+}
+
+// normalization is a resolved normalization mode, target and strategy
+type normalization struct {
+	mode     string
+	target   float64
+	strategy string
+
+	// Gain for the internal "gain" mode, used for the second pass of a two
+	// pass render, unity otherwise
+	gain float64
+}
+
+// resolveNormalization returns the normalization for the options, normalize
+// false disables normalization regardless of the options. An empty strategy
+// resolves to defaultStrategy
+func (options *SoundWriterOptions) resolveNormalization(normalize bool, defaultStrategy string) (*normalization, error) {
+	n := &normalization{
+		mode:     strings.ToLower(options.Normalize),
+		target:   options.NormalizeTarget,
+		strategy: strings.ToLower(options.NormalizeStrategy),
+		gain:     1.0,
+	}
+
+	if n.strategy == "" {
+		n.strategy = defaultStrategy
+	}
+
+	switch n.strategy {
+	case "tempfile", "memory", "twopass":
+	default:
+		return nil, fmt.Errorf("Unknown normalize strategy %v", options.NormalizeStrategy)
+	}
+
+	if !normalize {
+		n.mode = "none"
+	}
+
+	switch n.mode {
+	case "":
+		n.mode = "peak"
+		fallthrough
+	case "peak", "truepeak":
+		if n.target > 0.0 {
+			return nil, fmt.Errorf("Normalize target %v dBFS is above full scale", n.target)
+		}
+	case "loudness":
+		if n.target == 0.0 {
+			n.target = defaultLoudnessTarget
+		}
+	case "none":
+	default:
+		return nil, fmt.Errorf("Unknown normalize mode %v", options.Normalize)
+	}
+
+	return n, nil
+}
+
+// fixedGain returns a normalization that applies gain without measuring
+func fixedGain(gain float64) *normalization {
+	return &normalization{mode: "gain", gain: gain}
+}
+
+// buffered returns true if samples must be stored until the gain is known
+func (n *normalization) buffered() bool {
+	return n.mode != "none" && n.mode != "gain"
+}
+
+// stats returns the statistics of the meter and the gain that reaches the
+// normalization target
+func (n *normalization) stats(meter *loudnessMeter) *SoundStats {
+	stats := &SoundStats{
+		Frames:   meter.frames,
+		Peak:     meter.peak,
+		PeakDB:   amplitudeToDB(meter.peak),
+		TruePeak: meter.truePeakValue(),
+		Loudness: meter.integratedLoudness(),
+		Silent:   meter.peak == 0.0,
+	}
+
+	stats.TruePeakDB = amplitudeToDB(stats.TruePeak)
+	stats.Gain = n.gainFor(stats)
+	stats.GainDB = amplitudeToDB(stats.Gain)
+
+	return stats
+}
+
+// gainFor returns the gain that normalizes measured statistics to the target.
+// Silent output, or output without a measurable loudness, gets unity gain
+func (n *normalization) gainFor(stats *SoundStats) float64 {
+	if n.mode == "gain" {
+		return n.gain
+	}
+
+	if stats.Silent {
+		return 1.0
+	}
+
+	switch n.mode {
+	case "peak":
+		return dbToAmplitude(n.target) / stats.Peak
+	case "truepeak":
+		return dbToAmplitude(n.target) / stats.TruePeak
+	case "loudness":
+		if !math.IsInf(stats.Loudness, -1) {
+			return dbToAmplitude(n.target - stats.Loudness)
+		}
+	}
+
+	return 1.0
+}
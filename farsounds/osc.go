@@ -0,0 +1,329 @@
+package farsounds
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strings"
+)
+
+/*
+	Open Sound Control
+*/
+
+// OSCMessage is an OSC message with an address pattern and arguments.
+// Arguments are int32, int64, float32, float64, string, []byte, bool or nil
+type OSCMessage struct {
+	Address   string
+	Arguments []interface{}
+}
+
+// appendOSCUint32 appends a big endian 32 bit value
+func appendOSCUint32(data []byte, v uint32) []byte {
+	var b [4]byte
+	binary.BigEndian.PutUint32(b[:], v)
+	return append(data, b[:]...)
+}
+
+// appendOSCUint64 appends a big endian 64 bit value
+func appendOSCUint64(data []byte, v uint64) []byte {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], v)
+	return append(data, b[:]...)
+}
+
+// appendOSCString appends a null terminated string padded to 4 bytes
+func appendOSCString(data []byte, s string) []byte {
+	data = append(data, s...)
+	data = append(data, 0)
+
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+
+	return data
+}
+
+// appendOSCBlob appends a size prefixed blob padded to 4 bytes
+func appendOSCBlob(data []byte, blob []byte) []byte {
+	data = appendOSCUint32(data, uint32(len(blob)))
+	data = append(data, blob...)
+
+	for len(data)%4 != 0 {
+		data = append(data, 0)
+	}
+
+	return data
+}
+
+// MarshalBinary encodes the message. Go ints are sent as int32 and float64 as
+// float32, the types every OSC implementation understands
+func (message *OSCMessage) MarshalBinary() ([]byte, error) {
+	if !strings.HasPrefix(message.Address, "/") {
+		return nil, fmt.Errorf("OSC address %v does not start with /", message.Address)
+	}
+
+	tags := []byte{','}
+	var args []byte
+
+	for _, arg := range message.Arguments {
+		switch v := arg.(type) {
+		case int:
+			tags = append(tags, 'i')
+			args = appendOSCUint32(args, uint32(int32(v)))
+		case int32:
+			tags = append(tags, 'i')
+			args = appendOSCUint32(args, uint32(v))
+		case int64:
+			tags = append(tags, 'h')
+			args = appendOSCUint64(args, uint64(v))
+		case float32:
+			tags = append(tags, 'f')
+			args = appendOSCUint32(args, math.Float32bits(v))
+		case float64:
+			tags = append(tags, 'f')
+			args = appendOSCUint32(args, math.Float32bits(float32(v)))
+		case string:
+			tags = append(tags, 's')
+			args = appendOSCString(args, v)
+		case []byte:
+			tags = append(tags, 'b')
+			args = appendOSCBlob(args, v)
+		case bool:
+			if v {
+				tags = append(tags, 'T')
+			} else {
+				tags = append(tags, 'F')
+			}
+		case nil:
+			tags = append(tags, 'N')
+		default:
+			return nil, fmt.Errorf("Unsupported OSC argument type %T", arg)
+		}
+	}
+
+	data := appendOSCString(nil, message.Address)
+	data = appendOSCString(data, string(tags))
+
+	return append(data, args...), nil
+}
+
+// oscReader reads OSC values from a packet
+type oscReader struct {
+	data []byte
+	pos  int
+}
+
+var errOSCPacket = errors.New("Malformed OSC packet")
+
+func (r *oscReader) string() (string, error) {
+	end := r.pos
+	for end < len(r.data) && r.data[end] != 0 {
+		end++
+	}
+
+	if end >= len(r.data) {
+		return "", errOSCPacket
+	}
+
+	s := string(r.data[r.pos:end])
+	r.pos = (end + 4) &^ 3
+
+	return s, nil
+}
+
+func (r *oscReader) bytes(n int) ([]byte, error) {
+	if n < 0 || r.pos+n > len(r.data) {
+		return nil, errOSCPacket
+	}
+
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+
+	return b, nil
+}
+
+func (r *oscReader) uint32() (uint32, error) {
+	b, err := r.bytes(4)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint32(b), nil
+}
+
+func (r *oscReader) uint64() (uint64, error) {
+	b, err := r.bytes(8)
+	if err != nil {
+		return 0, err
+	}
+
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// ParseOSCPacket decodes an OSC packet, the messages of bundles are returned
+// in order and their time tags are ignored
+func ParseOSCPacket(data []byte) ([]*OSCMessage, error) {
+	if len(data)%4 != 0 {
+		return nil, errOSCPacket
+	}
+
+	r := &oscReader{data: data}
+
+	address, err := r.string()
+	if err != nil {
+		return nil, err
+	}
+
+	if address == "#bundle" {
+		// Skip the time tag
+		_, err = r.uint64()
+		if err != nil {
+			return nil, err
+		}
+
+		var messages []*OSCMessage
+
+		for r.pos < len(data) {
+			size, err := r.uint32()
+			if err != nil {
+				return nil, err
+			}
+
+			element, err := r.bytes(int(size))
+			if err != nil {
+				return nil, err
+			}
+
+			elementMessages, err := ParseOSCPacket(element)
+			if err != nil {
+				return nil, err
+			}
+
+			messages = append(messages, elementMessages...)
+		}
+
+		return messages, nil
+	}
+
+	if !strings.HasPrefix(address, "/") {
+		return nil, errOSCPacket
+	}
+
+	message := &OSCMessage{Address: address}
+
+	// Messages without type tags have no arguments
+	if r.pos >= len(data) {
+		return []*OSCMessage{message}, nil
+	}
+
+	tags, err := r.string()
+	if err != nil {
+		return nil, err
+	}
+
+	if !strings.HasPrefix(tags, ",") {
+		return nil, errOSCPacket
+	}
+
+	for _, tag := range tags[1:] {
+		var arg interface{}
+
+		switch tag {
+		case 'i':
+			v, err := r.uint32()
+			if err != nil {
+				return nil, err
+			}
+
+			arg = int32(v)
+		case 'h':
+			v, err := r.uint64()
+			if err != nil {
+				return nil, err
+			}
+
+			arg = int64(v)
+		case 'f':
+			v, err := r.uint32()
+			if err != nil {
+				return nil, err
+			}
+
+			arg = math.Float32frombits(v)
+		case 'd':
+			v, err := r.uint64()
+			if err != nil {
+				return nil, err
+			}
+
+			arg = math.Float64frombits(v)
+		case 's', 'S':
+			v, err := r.string()
+			if err != nil {
+				return nil, err
+			}
+
+			arg = v
+		case 'b':
+			size, err := r.uint32()
+			if err != nil {
+				return nil, err
+			}
+
+			v, err := r.bytes(int(size))
+			if err != nil {
+				return nil, err
+			}
+
+			arg = append([]byte(nil), v...)
+			r.pos = (r.pos + 3) &^ 3
+		case 'T':
+			arg = true
+		case 'F':
+			arg = false
+		case 'N', 'I':
+			arg = nil
+		default:
+			return nil, fmt.Errorf("Unsupported OSC type tag %c", tag)
+		}
+
+		message.Arguments = append(message.Arguments, arg)
+	}
+
+	return []*OSCMessage{message}, nil
+}
+
+// OSCClient sends OSC messages over UDP
+type OSCClient struct {
+	conn net.Conn
+}
+
+// NewOSCClient creates a client that sends to a host:port address
+func NewOSCClient(address string) (*OSCClient, error) {
+	conn, err := net.Dial("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OSCClient{conn: conn}, nil
+}
+
+// Send a message with arguments to an OSC address
+func (client *OSCClient) Send(address string, args ...interface{}) error {
+	data, err := (&OSCMessage{Address: address, Arguments: args}).MarshalBinary()
+	if err != nil {
+		return err
+	}
+
+	_, err = client.conn.Write(data)
+
+	return err
+}
+
+// Close the client
+func (client *OSCClient) Close() error {
+	return client.conn.Close()
+}
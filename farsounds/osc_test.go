@@ -0,0 +1,185 @@
+package farsounds
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestOSCRoundTrip(t *testing.T) {
+	message := &OSCMessage{
+		Address:   "/osc1/frequency",
+		Arguments: []interface{}{int32(-3), int64(1) << 40, float32(0.5), 440.0, "abc", []byte{1, 2, 3}, true, false, nil, 7},
+	}
+
+	data, err := message.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data)%4 != 0 {
+		t.Fatalf("Packet of %d bytes is not padded", len(data))
+	}
+
+	messages, err := ParseOSCPacket(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*OSCMessage{{
+		Address:   "/osc1/frequency",
+		Arguments: []interface{}{int32(-3), int64(1) << 40, float32(0.5), float32(440.0), "abc", []byte{1, 2, 3}, true, false, nil, int32(7)},
+	}}
+
+	if !reflect.DeepEqual(messages, expected) {
+		t.Fatalf("Parsed %#v", messages[0])
+	}
+
+	if _, err := (&OSCMessage{Address: "osc1"}).MarshalBinary(); err == nil {
+		t.Error("Address without / was encoded")
+	}
+
+	if _, err := (&OSCMessage{Address: "/osc1", Arguments: []interface{}{struct{}{}}}).MarshalBinary(); err == nil {
+		t.Error("Unsupported argument was encoded")
+	}
+}
+
+// oscBundle encodes a bundle with elements
+func oscBundle(elements ...[]byte) []byte {
+	data := appendOSCString(nil, "#bundle")
+	data = appendOSCUint64(data, 1)
+
+	for _, element := range elements {
+		data = appendOSCUint32(data, uint32(len(element)))
+		data = append(data, element...)
+	}
+
+	return data
+}
+
+func TestOSCBundle(t *testing.T) {
+	first, _ := (&OSCMessage{Address: "/a", Arguments: []interface{}{int32(1)}}).MarshalBinary()
+	second, _ := (&OSCMessage{Address: "/b"}).MarshalBinary()
+	third, _ := (&OSCMessage{Address: "/c", Arguments: []interface{}{"x"}}).MarshalBinary()
+
+	messages, err := ParseOSCPacket(oscBundle(first, oscBundle(second, third)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []*OSCMessage{
+		{Address: "/a", Arguments: []interface{}{int32(1)}},
+		{Address: "/b"},
+		{Address: "/c", Arguments: []interface{}{"x"}},
+	}
+
+	if !reflect.DeepEqual(messages, expected) {
+		t.Fatalf("Parsed %v", messages)
+	}
+
+	// A message without type tags has no arguments
+	messages, err = ParseOSCPacket(appendOSCString(nil, "/d"))
+	if err != nil || len(messages) != 1 || messages[0].Address != "/d" || len(messages[0].Arguments) != 0 {
+		t.Fatalf("Parsed %v, %v", messages, err)
+	}
+}
+
+func TestOSCMalformed(t *testing.T) {
+	valid, _ := (&OSCMessage{Address: "/a", Arguments: []interface{}{int32(1), "abc"}}).MarshalBinary()
+
+	// Bundle with an element that is larger than the bundle
+	oversized := oscBundle(valid)
+	oversized[19] += 4
+
+	packets := map[string][]byte{
+		"empty":              {},
+		"unpadded":           valid[:len(valid)-1],
+		"truncated argument": valid[:12],
+		"unterminated":       []byte("/abc"),
+		"no slash":           appendOSCString(appendOSCString(nil, "a"), ",i"),
+		"no comma":           appendOSCString(appendOSCString(nil, "/a"), "i"),
+		"unknown tag":        appendOSCString(appendOSCString(nil, "/a"), ",x"),
+		"truncated time tag": appendOSCString(nil, "#bundle"),
+		"oversized element":  oversized,
+		"malformed element":  oscBundle([]byte("/abc")),
+	}
+
+	for name, packet := range packets {
+		if messages, err := ParseOSCPacket(packet); err == nil {
+			t.Errorf("Malformed packet %v parsed as %v", name, messages)
+		}
+	}
+}
+
+func TestOSCServerLoopback(t *testing.T) {
+	server, err := NewOSCServer("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server.Prefix = "/main"
+	server.Start()
+
+	client, err := NewOSCClient(server.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer client.Close()
+
+	patch := NewPatch(0, 0, 64, 44100.0)
+	osc := newRecorder(patch, "osc1")
+	poly := newRecorder(patch, "poly")
+
+	sends := [][]interface{}{
+		{"/other/osc1/frequency", 220.0},
+		{"/main/osc1/frequency", 440.0},
+		{"/main/osc1/range", int32(1), 2.5},
+		{"/main/osc1/reset"},
+		{"/main/poly", `{"noteOn": 60, "settings": {"amplitude": 0.5}}`},
+	}
+
+	for _, send := range sends {
+		err = client.Send(send[0].(string), send[1:]...)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for timestamp := int64(0); len(osc.received) < 3 || len(poly.received) < 1; timestamp += 64 {
+		if time.Now().After(deadline) {
+			t.Fatalf("Received %v and %v", osc.received, poly.received)
+		}
+
+		server.Dispatch(patch, timestamp)
+		time.Sleep(time.Millisecond)
+	}
+
+	err = server.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if server.Err() != nil {
+		t.Fatal(server.Err())
+	}
+
+	expected := []Message{
+		map[string]interface{}{"frequency": 440.0},
+		map[string]interface{}{"range": []interface{}{1.0, 2.5}},
+		map[string]interface{}{"reset": true},
+	}
+
+	for i, message := range expected {
+		if !reflect.DeepEqual(osc.received[i].message, message) {
+			t.Errorf("osc1 received %v, expected %v", osc.received[i].message, message)
+		}
+	}
+
+	noteOn := map[string]interface{}{"noteOn": 60.0, "settings": map[string]interface{}{"amplitude": 0.5}}
+	if !reflect.DeepEqual(poly.received[0].message, noteOn) {
+		t.Errorf("poly received %v", poly.received[0].message)
+	}
+}
@@ -0,0 +1,193 @@
+package farsounds
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"strings"
+	"sync"
+)
+
+/*
+	OSC server
+*/
+
+// Maximum size of an OSC packet over UDP
+const oscMaxPacketSize = 65536
+
+// OSCServer receives OSC messages over UDP and sends them to the modules of a
+// patch. The last component of an OSC address is the parameter, the rest is
+// the module address: /osc1/frequency 440 sends {"frequency": 440} to
+// osc1. Numbers are converted to float64, multiple arguments are sent as a
+// list and no arguments as true. A single string argument that holds a JSON
+// object is sent as the message to the full address instead, so
+// /poly '{"noteOn": 60, "settings": {...}}' reaches poly. Messages are received
+// on a separate goroutine and delivered on the audio thread by Dispatch
+type OSCServer struct {
+	// Prefix that is stripped from OSC addresses, for example /main, messages
+	// without the prefix are ignored
+	Prefix string
+
+	conn *net.UDPConn
+
+	// Messages waiting for the next Dispatch
+	queue *MessageQueue
+
+	// Receiver goroutine and the error that stopped it
+	done  chan struct{}
+	mutex sync.Mutex
+	err   error
+}
+
+// NewOSCServer creates a server that listens on a UDP host:port address, use
+// port 0 to pick a free port
+func NewOSCServer(address string) (*OSCServer, error) {
+	udpAddress, err := net.ResolveUDPAddr("udp", address)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := net.ListenUDP("udp", udpAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	return &OSCServer{
+		conn:  conn,
+		queue: NewMessageQueue(defaultMessageQueueCapacity),
+	}, nil
+}
+
+// LocalAddr returns the address the server listens on
+func (server *OSCServer) LocalAddr() net.Addr {
+	return server.conn.LocalAddr()
+}
+
+// Start receiving messages on a separate goroutine
+func (server *OSCServer) Start() {
+	server.done = make(chan struct{})
+
+	go func() {
+		defer close(server.done)
+
+		buffer := make([]byte, oscMaxPacketSize)
+
+		for {
+			n, _, err := server.conn.ReadFromUDP(buffer)
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					server.mutex.Lock()
+					server.err = err
+					server.mutex.Unlock()
+				}
+
+				return
+			}
+
+			// Malformed packets are dropped
+			messages, err := ParseOSCPacket(buffer[:n])
+			if err != nil {
+				continue
+			}
+
+			for _, message := range messages {
+				server.Handle(message)
+			}
+		}
+	}()
+}
+
+// Handle translates an OSC message to a message for the next Dispatch. Only
+// one goroutine may call Handle, after Start that is the receiver. Messages
+// are dropped if the queue is full
+func (server *OSCServer) Handle(message *OSCMessage) {
+	address := message.Address
+
+	if server.Prefix != "" {
+		prefix := "/" + strings.Trim(server.Prefix, "/")
+		if address != prefix && !strings.HasPrefix(address, prefix+"/") {
+			return
+		}
+
+		address = strings.TrimPrefix(address, prefix)
+	}
+
+	address = strings.Trim(address, "/")
+	if address == "" {
+		return
+	}
+
+	// A JSON object is the message for the full address
+	if len(message.Arguments) == 1 {
+		if s, ok := message.Arguments[0].(string); ok && strings.HasPrefix(strings.TrimSpace(s), "{") {
+			var value map[string]interface{}
+			if json.Unmarshal([]byte(s), &value) == nil {
+				server.queue.Push(address, value)
+			}
+
+			return
+		}
+	}
+
+	i := strings.LastIndex(address, "/")
+	if i < 0 {
+		return
+	}
+
+	var value interface{}
+
+	switch len(message.Arguments) {
+	case 0:
+		value = true
+	case 1:
+		value = oscMessageValue(message.Arguments[0])
+	default:
+		values := make([]interface{}, len(message.Arguments))
+		for j, arg := range message.Arguments {
+			values[j] = oscMessageValue(arg)
+		}
+
+		value = values
+	}
+
+	server.queue.Push(address[:i], map[string]interface{}{address[i+1:]: value})
+}
+
+// oscMessageValue converts OSC numbers to float64, the number type of messages
+func oscMessageValue(arg interface{}) interface{} {
+	switch v := arg.(type) {
+	case int32:
+		return float64(v)
+	case int64:
+		return float64(v)
+	case float32:
+		return float64(v)
+	}
+
+	return arg
+}
+
+// Dispatch sends the pending messages to the modules of patch, call it from
+// the audio thread before the DSP of the block at timestamp
+func (server *OSCServer) Dispatch(patch Module, timestamp int64) {
+	server.queue.Deliver(patch, timestamp)
+}
+
+// Close the server and wait for the receiver goroutine to finish
+func (server *OSCServer) Close() error {
+	err := server.conn.Close()
+
+	if server.done != nil {
+		<-server.done
+	}
+
+	return err
+}
+
+// Err returns the error that stopped receiving messages, if any
+func (server *OSCServer) Err() error {
+	server.mutex.Lock()
+	defer server.mutex.Unlock()
+
+	return server.err
+}
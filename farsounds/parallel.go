@@ -0,0 +1,154 @@
+package farsounds
+
+import (
+	"runtime"
+	"sync"
+	"sync/atomic"
+)
+
+/*
+	Worker pool
+*/
+
+// workerPool runs tasks on a fixed amount of goroutines
+type workerPool struct {
+	tasks chan func()
+}
+
+var (
+	sharedPool     *workerPool
+	sharedPoolOnce sync.Once
+)
+
+// getWorkerPool returns the worker pool shared by all parallel schedules,
+// the pool is started on first use with one worker per CPU
+func getWorkerPool() *workerPool {
+	sharedPoolOnce.Do(func() {
+		numWorkers := runtime.GOMAXPROCS(0)
+
+		sharedPool = &workerPool{
+			tasks: make(chan func(), numWorkers*4),
+		}
+
+		for i := 0; i < numWorkers; i++ {
+			go func() {
+				for task := range sharedPool.tasks {
+					task()
+				}
+			}()
+		}
+	})
+
+	return sharedPool
+}
+
+// run calls task for 0 up to n and returns when all calls are done. The calling
+// goroutine helps executing queued tasks while it waits, so run can be called
+// from inside a task (nested patches) without deadlocking the pool
+func (pool *workerPool) run(n int, task func(i int)) {
+	if n <= 0 {
+		return
+	}
+
+	remaining := int64(n)
+	done := make(chan struct{})
+
+	exec := func(i int) {
+		task(i)
+
+		if atomic.AddInt64(&remaining, -1) == 0 {
+			close(done)
+		}
+	}
+
+	// Queue all but the first task, if the queue is full run the task here
+	for i := 1; i < n; i++ {
+		index := i
+
+		select {
+		case pool.tasks <- func() { exec(index) }:
+		default:
+			exec(index)
+		}
+	}
+
+	// Run first task ourselves
+	exec(0)
+
+	// Help out until all our tasks are done
+	for {
+		select {
+		case <-done:
+			return
+		case task := <-pool.tasks:
+			task()
+		}
+	}
+}
+
+/*
+	Parallel schedule
+*/
+
+// computeLevels divides the steps of the schedule in levels. Steps in the same
+// level do not depend on each other and can be processed at the same time,
+// levels are processed in order. A step reading the outlet of a step later in
+// the plan (an undeclared cycle) reads the previous output, so that later step
+// is placed in a higher level to keep the result equal to the serial schedule
+func (s *schedule) computeLevels() {
+	stepIndex := make(map[Module]int, len(s.steps))
+	for i, step := range s.steps {
+		stepIndex[step.module] = i
+	}
+
+	// Call fn with the step index of every module connected to the inlets of
+	// module, feedback connections are skipped
+	forEachSource := func(module Module, fn func(j int)) {
+		for _, inlet := range module.GetInlets() {
+			for e := inlet.Connections.Front(); e != nil; e = e.Next() {
+				conn := e.Value.(*Connection)
+
+				if conn.Feedback {
+					continue
+				}
+
+				if j, ok := stepIndex[conn.To]; ok {
+					fn(j)
+				}
+			}
+		}
+	}
+
+	stepLevel := make([]int, len(s.steps))
+	minLevel := make([]int, len(s.steps))
+	numLevels := 0
+
+	for i, step := range s.steps {
+		level := minLevel[i]
+
+		// Sources processed before us must be in a lower level
+		forEachSource(step.module, func(j int) {
+			if j < i && stepLevel[j]+1 > level {
+				level = stepLevel[j] + 1
+			}
+		})
+
+		// Sources reading their previous output must wait for us
+		forEachSource(step.module, func(j int) {
+			if j > i && level+1 > minLevel[j] {
+				minLevel[j] = level + 1
+			}
+		})
+
+		stepLevel[i] = level
+
+		if level+1 > numLevels {
+			numLevels = level + 1
+		}
+	}
+
+	s.levels = make([][]int, numLevels)
+	for i, level := range stepLevel {
+		s.levels[level] = append(s.levels[level], i)
+	}
+}
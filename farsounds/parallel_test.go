@@ -0,0 +1,13 @@
+package farsounds_test
+
+import (
+	"testing"
+
+	"github.com/almerlucke/go-farsounds/farsounds"
+)
+
+func TestParallelMatchesSerial(t *testing.T) {
+	for _, numModules := range []int{10, 100, 300} {
+		compareSchedules(t, farsounds.ScheduleParallel, numModules, 20, 64, 44100.0)
+	}
+}
@@ -0,0 +1,195 @@
+package farsounds
+
+import "math"
+
+/*
+	Parameters
+*/
+
+// Param is a module parameter that ramps to new values instead of jumping,
+// modules check Ramping every sample and advance it with Next while it ramps.
+// A message sets a parameter with a number, which ramps over the smoothing
+// time of the parameter, or with a ramp {"value", "time", "curve"} where time
+// is in seconds and curve is "linear" (default), "exponential" or a number
+// that bends the ramp, negative numbers start fast and positive numbers start
+// slow. Until the parameter is first processed values are set immediately, so
+// the settings of a new module do not ramp
+type Param struct {
+	// Current value
+	Value float64
+
+	// Ramp time in seconds of values set without a ramp
+	Smoothing float64
+
+	// Ramp
+	start       float64
+	target      float64
+	curve       float64
+	exponential bool
+	position    int64
+	length      int64
+
+	// Set once the parameter is processed
+	running bool
+}
+
+// NewParam creates a parameter with a value and smoothing time in seconds
+func NewParam(value float64, smoothing float64) *Param {
+	return &Param{
+		Value:     value,
+		Smoothing: smoothing,
+		target:    value,
+	}
+}
+
+// Set the parameter from a message value, a number or a ramp. Returns false
+// if the value is neither
+func (param *Param) Set(value interface{}, sr float64) bool {
+	switch v := value.(type) {
+	case float64:
+		param.RampTo(v, param.Smoothing, nil, sr)
+	case map[string]interface{}:
+		target, ok := v["value"].(float64)
+		if !ok {
+			return false
+		}
+
+		seconds, _ := v["time"].(float64)
+
+		param.RampTo(target, seconds, v["curve"], sr)
+	default:
+		return false
+	}
+
+	return true
+}
+
+// RampTo ramps the parameter to target in seconds, curve is nil, "linear",
+// "exponential" or a number. Exponential ramps between values of a different
+// sign, or from or to zero, are linear
+func (param *Param) RampTo(target float64, seconds float64, curve interface{}, sr float64) {
+	length := int64(seconds * sr)
+
+	if !param.running || length <= 0 {
+		param.Jump(target)
+		return
+	}
+
+	param.start = param.Value
+	param.target = target
+	param.position = 0
+	param.length = length
+	param.curve = 0.0
+	param.exponential = false
+
+	switch c := curve.(type) {
+	case string:
+		param.exponential = c == "exponential" && param.start*target > 0.0
+	case float64:
+		param.curve = c
+	}
+}
+
+// Jump to a value immediately
+func (param *Param) Jump(value float64) {
+	param.Value = value
+	param.target = value
+	param.position = 0
+	param.length = 0
+}
+
+// Ramping returns true while the parameter ramps, it marks the parameter as
+// processed so later values ramp
+func (param *Param) Ramping() bool {
+	param.running = true
+	return param.position < param.length
+}
+
+// Next advances the parameter one sample and returns its value
+func (param *Param) Next() float64 {
+	param.running = true
+
+	if param.position >= param.length {
+		return param.Value
+	}
+
+	param.position++
+
+	if param.position == param.length {
+		param.Value = param.target
+		return param.Value
+	}
+
+	t := float64(param.position) / float64(param.length)
+
+	switch {
+	case param.exponential:
+		param.Value = param.start * math.Pow(param.target/param.start, t)
+	case math.Abs(param.curve) > 0.001:
+		param.Value = param.start + (param.target-param.start)*(1.0-math.Exp(param.curve*t))/(1.0-math.Exp(param.curve))
+	default:
+		param.Value = param.start + (param.target-param.start)*t
+	}
+
+	return param.Value
+}
+
+// Advance the parameter n samples and return its value, for block rate
+// processing and fast forwarding
+func (param *Param) Advance(n int64) float64 {
+	param.running = true
+
+	if n <= 0 || param.position >= param.length {
+		return param.Value
+	}
+
+	if param.position+n > param.length {
+		n = param.length - param.position
+	}
+
+	param.position += n - 1
+
+	return param.Next()
+}
+
+// ParamSet holds the parameters of a module by message key
+type ParamSet map[string]*Param
+
+// Message sets the parameters in a message map, returns true if a parameter
+// was set
+func (params ParamSet) Message(message Message, sr float64) bool {
+	valueMap, ok := message.(map[string]interface{})
+	if !ok {
+		return false
+	}
+
+	set := false
+
+	for key, param := range params {
+		if value, ok := valueMap[key]; ok && param.Set(value, sr) {
+			set = true
+		}
+	}
+
+	return set
+}
+
+// Ramping returns true if one of the parameters ramps, see Param.Ramping
+func (params ParamSet) Ramping() bool {
+	ramping := false
+
+	for _, param := range params {
+		if param.Ramping() {
+			ramping = true
+		}
+	}
+
+	return ramping
+}
+
+// Advance all parameters n samples, see Param.Advance
+func (params ParamSet) Advance(n int64) {
+	for _, param := range params {
+		param.Advance(n)
+	}
+}
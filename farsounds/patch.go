@@ -3,6 +3,8 @@ package farsounds
 import (
 	"container/list"
 	"fmt"
+	"path/filepath"
+	"strings"
 
 	"github.com/mitchellh/mapstructure"
 )
@@ -13,10 +15,11 @@ import (
 
 // ScriptConnectionDescriptor for script mapping
 type ScriptConnectionDescriptor struct {
-	From   string
-	Outlet int
-	To     string
-	Inlet  int
+	From     string
+	Outlet   int
+	To       string
+	Inlet    int
+	Feedback bool
 }
 
 // ScriptModuleDescriptor for script mapping
@@ -25,13 +28,35 @@ type ScriptModuleDescriptor struct {
 	Settings interface{}
 }
 
-// ScriptPatchSettingsDescriptor for script mapping
+// ScriptPatchSettingsDescriptor for script mapping, arguments holds the
+// default values of the arguments of a patch script
 type ScriptPatchSettingsDescriptor struct {
+	Arguments   map[string]interface{}
 	NumInlets   int
 	NumOutlets  int
 	Modules     map[string]interface{}
 	Connections []interface{}
-	Scores      []string
+	Scores      []interface{}
+	Schedule    string
+}
+
+// ScriptScoreDescriptor for script mapping of a score with settings, MIDI
+// files can have routes from tracks and channels to module addresses. The
+// name addresses the player, the other settings set its transport
+type ScriptScoreDescriptor struct {
+	File   string
+	Routes []*MIDIRoute
+	Name   string
+	Rate   float64
+	Loop   *ScriptScoreLoopDescriptor
+	Paused bool
+	Muted  bool
+}
+
+// ScriptScoreLoopDescriptor for script mapping of a loop region in seconds
+type ScriptScoreLoopDescriptor struct {
+	Start float64
+	End   float64
 }
 
 /*
@@ -100,6 +125,11 @@ func (module *OutletModule) DSP(timestamp int64) {
 // Patch is a container module abstracting a cluster of connected modules
 // into one module
 type Patch struct {
+	// Connection generation, increased when modules of the patch connect or
+	// disconnect. The 64 bit field comes first for atomic access on 32 bit
+	// platforms
+	generation uint64
+
 	// Ptr to base module implementation
 	*BaseModule
 
@@ -116,6 +146,12 @@ type Patch struct {
 
 	// List of score players in this patch
 	ScorePlayers *list.List
+
+	// Schedule mode used to perform DSP on the internal modules
+	Schedule ScheduleMode
+
+	// Compiled execution plan, rebuilt when connections change
+	schedule *schedule
 }
 
 // NewPatch creates a new patch module
@@ -158,24 +194,35 @@ func NewPatch(numInlets int, numOutlets int, buflen int32, sr float64) *Patch {
 	return patch
 }
 
-// PatchFactory creates patches from settings
+// PatchFactory creates patches from settings. Settings are a patch script
+// file path, a reference {"file", "arguments"} to a patch script with
+// arguments or the patch settings themselves. A patch script declares its
+// arguments with default values in "arguments", strings in the script refer
+// to them as $name or ${name}, $$ is a $. A string that is a single reference
+// becomes the argument value, a string that is an arithmetic expression such
+// as "$base * 1.5" becomes a number and the references of other strings are
+// replaced by the text of the arguments
 func PatchFactory(settings interface{}, buflen int32, sr float64) (Module, error) {
 	var err error
 
 	// If settings is a string, it represents a file path for the settings script.
 	// Eval the settings script and return loaded patch
 	if filePath, ok := settings.(string); ok {
-		var _module interface{}
+		return newPatchFromScript(filePath, nil, buflen, sr)
+	}
 
-		_module, err = EvalScript(filePath, func(patchSettings interface{}) (interface{}, error) {
-			return PatchFactory(patchSettings, buflen, sr)
-		})
+	// A reference to a patch script with arguments
+	if settingsMap, ok := settings.(map[string]interface{}); ok {
+		if _, ok := settingsMap["file"]; ok {
+			reference := ScriptPatchReferenceDescriptor{}
 
-		if err != nil {
-			return nil, err
-		}
+			err = mapstructure.Decode(settings, &reference)
+			if err != nil {
+				return nil, err
+			}
 
-		return _module.(Module), nil
+			return newPatchFromScript(reference.File, reference.Arguments, buflen, sr)
+		}
 	}
 
 	// Create patch descriptor from raw map
@@ -189,6 +236,18 @@ func PatchFactory(settings interface{}, buflen int32, sr float64) (Module, error
 	// Create new patch
 	patch := NewPatch(pdesc.NumInlets, pdesc.NumOutlets, buflen, sr)
 
+	// Set schedule mode, compiled is the default
+	switch pdesc.Schedule {
+	case "", "compiled":
+		patch.Schedule = ScheduleCompiled
+	case "pull":
+		patch.Schedule = SchedulePull
+	case "parallel":
+		patch.Schedule = ScheduleParallel
+	default:
+		return nil, fmt.Errorf("Unknown schedule %v for patch", pdesc.Schedule)
+	}
+
 	// Modules lookup for making connections easier
 	modules := make(map[string]Module)
 
@@ -239,27 +298,139 @@ func PatchFactory(settings interface{}, buflen int32, sr float64) (Module, error
 		}
 
 		to := modules[cdesc.To]
-		if from == nil {
+		if to == nil {
 			continue
 		}
 
-		from.Connect(cdesc.Outlet, to, cdesc.Inlet)
+		if cdesc.Feedback {
+			from.ConnectFeedback(cdesc.Outlet, to, cdesc.Inlet)
+		} else {
+			from.Connect(cdesc.Outlet, to, cdesc.Inlet)
+		}
+	}
+
+	// Cycles must be closed with a feedback connection
+	err = patch.CheckCycles()
+	if err != nil {
+		return nil, err
 	}
 
 	// Create scores
-	for _, scoreFilePath := range pdesc.Scores {
-		score, err := LoadScore(scoreFilePath)
+	for _, _sdesc := range pdesc.Scores {
+		player, err := newScriptScorePlayer(_sdesc)
 		if err != nil {
 			return nil, err
 		}
 
-		player := NewScorePlayer(score)
 		patch.ScorePlayers.PushBack(player)
 	}
 
 	return patch, nil
 }
 
+// newPatchFromScript creates a patch from a patch script file with arguments,
+// arguments the script does not declare are an error. Scripts without
+// arguments are not substituted, so their strings can have a $
+func newPatchFromScript(filePath string, arguments map[string]interface{}, buflen int32, sr float64) (Module, error) {
+	_module, err := EvalScript(filePath, func(patchSettings interface{}) (interface{}, error) {
+		settingsMap, ok := patchSettings.(map[string]interface{})
+		if !ok {
+			return PatchFactory(patchSettings, buflen, sr)
+		}
+
+		_, declared := settingsMap["arguments"]
+		if !declared && len(arguments) == 0 {
+			return PatchFactory(settingsMap, buflen, sr)
+		}
+
+		defaults, _ := settingsMap["arguments"].(map[string]interface{})
+
+		values := make(map[string]interface{}, len(defaults))
+		for name, value := range defaults {
+			values[name] = value
+		}
+
+		for name, value := range arguments {
+			if _, ok := defaults[name]; !ok {
+				return nil, fmt.Errorf("Patch %v has no argument %v", filePath, name)
+			}
+
+			values[name] = value
+		}
+
+		// The defaults are not substituted
+		script := make(map[string]interface{}, len(settingsMap))
+
+		for key, value := range settingsMap {
+			if key == "arguments" {
+				continue
+			}
+
+			substituted, err := substituteArguments(value, values)
+			if err != nil {
+				return nil, fmt.Errorf("Patch %v: %v", filePath, err)
+			}
+
+			script[key] = substituted
+		}
+
+		return PatchFactory(script, buflen, sr)
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return _module.(Module), nil
+}
+
+// newScriptScorePlayer creates a score player from a file path or a score
+// descriptor
+func newScriptScorePlayer(settings interface{}) (*ScorePlayer, error) {
+	if filePath, ok := settings.(string); ok {
+		score, err := LoadScore(filePath)
+		if err != nil {
+			return nil, err
+		}
+
+		return NewScorePlayer(score), nil
+	}
+
+	sdesc := ScriptScoreDescriptor{}
+	err := mapstructure.Decode(settings, &sdesc)
+	if err != nil {
+		return nil, err
+	}
+
+	var score *Score
+
+	ext := strings.ToLower(filepath.Ext(sdesc.File))
+	if len(sdesc.Routes) > 0 && (ext == ".mid" || ext == ".midi") {
+		score, err = LoadMIDIScore(sdesc.File, sdesc.Routes)
+	} else {
+		score, err = LoadScore(sdesc.File)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	player := NewScorePlayer(score)
+	player.Identifier = sdesc.Name
+	player.Paused = sdesc.Paused
+	player.Muted = sdesc.Muted
+
+	if sdesc.Rate > 0.0 {
+		player.Rate = sdesc.Rate
+	}
+
+	if sdesc.Loop != nil {
+		player.SetLoop(sdesc.Loop.Start, sdesc.Loop.End)
+	}
+
+	return player, nil
+}
+
 /*
 	Patch methods
 */
@@ -267,6 +438,13 @@ func PatchFactory(settings interface{}, buflen int32, sr float64) (Module, error
 // AddModule convenience function
 func (patch *Patch) AddModule(module Module) {
 	patch.Modules.PushBack(module)
+
+	if m, ok := module.(graphModule); ok {
+		m.setGeneration(&patch.generation)
+	}
+
+	// Force a recompile of the execution plan
+	patch.schedule = nil
 }
 
 // DSP processor for patch, perform DSP on internal modules
@@ -277,6 +455,43 @@ func (patch *Patch) DSP(timestamp int64) {
 		player.Play(patch)
 	}
 
+	switch patch.Schedule {
+	case SchedulePull:
+		patch.pullDSP(timestamp)
+	case ScheduleParallel:
+		patch.compiledSchedule().runParallel(timestamp)
+	default:
+		patch.compiledSchedule().run(timestamp)
+	}
+}
+
+// FastForward plays the score players and fast forwards the internal modules
+// that support it, other modules keep their state
+func (patch *Patch) FastForward(timestamp int64) {
+	for e := patch.ScorePlayers.Front(); e != nil; e = e.Next() {
+		player := e.Value.(*ScorePlayer)
+		player.Play(patch)
+	}
+
+	for e := patch.Modules.Front(); e != nil; e = e.Next() {
+		if fastForwarder, ok := e.Value.(FastForwarder); ok {
+			fastForwarder.FastForward(timestamp)
+		}
+	}
+}
+
+// compiledSchedule returns the compiled execution plan, the plan is recompiled
+// first if connections changed since the last compile
+func (patch *Patch) compiledSchedule() *schedule {
+	if patch.schedule == nil || !patch.schedule.isValid(patch) {
+		patch.schedule = compileSchedule(patch)
+	}
+
+	return patch.schedule
+}
+
+// pullDSP recursively pulls DSP from the outlet modules
+func (patch *Patch) pullDSP(timestamp int64) {
 	// Prepare all modules first
 	for e := patch.Modules.Front(); e != nil; e = e.Next() {
 		module := e.Value.(Module)
@@ -289,6 +504,126 @@ func (patch *Patch) DSP(timestamp int64) {
 	for _, outletModule := range patch.OutletModules {
 		outletModule.RequestDSP(timestamp)
 	}
+
+	// Pull sources of feedback connections, they might only be reachable
+	// through the feedback connection
+	patch.forEachFeedback(func(conn *Connection, source *Outlet) {
+		conn.To.RequestDSP(timestamp)
+	})
+
+	// Store output for feedback connections
+	patch.forEachFeedback(func(conn *Connection, source *Outlet) {
+		copy(conn.Buffer, source.Buffer)
+	})
+}
+
+// forEachFeedback calls fn for every feedback connection to a module in this
+// patch, with the outlet the connection reads from
+func (patch *Patch) forEachFeedback(fn func(conn *Connection, source *Outlet)) {
+	for e := patch.Modules.Front(); e != nil; e = e.Next() {
+		module := e.Value.(Module)
+
+		for _, inlet := range module.GetInlets() {
+			for c := inlet.Connections.Front(); c != nil; c = c.Next() {
+				conn := c.Value.(*Connection)
+
+				if conn.Feedback {
+					fn(conn, conn.To.GetOutlets()[conn.Index])
+				}
+			}
+		}
+	}
+}
+
+// FindCycle returns the modules forming a cycle that is not closed by a
+// feedback connection, or nil if there is no such cycle
+func (patch *Patch) FindCycle() []Module {
+	const (
+		unvisited = iota
+		visiting
+		done
+	)
+
+	state := make(map[Module]int)
+
+	for e := patch.Modules.Front(); e != nil; e = e.Next() {
+		state[e.Value.(Module)] = unvisited
+	}
+
+	var path []Module
+	var cycle []Module
+
+	var visit func(module Module) bool
+
+	visit = func(module Module) bool {
+		state[module] = visiting
+		path = append(path, module)
+
+		for _, outlet := range module.GetOutlets() {
+			for e := outlet.Connections.Front(); e != nil; e = e.Next() {
+				conn := e.Value.(*Connection)
+
+				if conn.Feedback {
+					continue
+				}
+
+				otherState, ok := state[conn.To]
+				if !ok || otherState == done {
+					continue
+				}
+
+				if otherState == visiting {
+					// Found a cycle, collect path from the module we are
+					// revisiting up to here
+					for i, pathModule := range path {
+						if pathModule == conn.To {
+							cycle = append(cycle, path[i:]...)
+							cycle = append(cycle, conn.To)
+							break
+						}
+					}
+
+					return true
+				}
+
+				if visit(conn.To) {
+					return true
+				}
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[module] = done
+
+		return false
+	}
+
+	for e := patch.Modules.Front(); e != nil; e = e.Next() {
+		module := e.Value.(Module)
+
+		if state[module] == unvisited && visit(module) {
+			return cycle
+		}
+	}
+
+	return nil
+}
+
+// CheckCycles returns an error if the patch contains a cycle that is not
+// closed by a feedback connection
+func (patch *Patch) CheckCycles() error {
+	cycle := patch.FindCycle()
+	if cycle == nil {
+		return nil
+	}
+
+	identifiers := make([]string, len(cycle))
+	for i, module := range cycle {
+		identifiers[i] = module.GetIdentifier()
+	}
+
+	return fmt.Errorf("Undeclared cycle %v in patch, mark one of the connections as feedback",
+		strings.Join(identifiers, " -> "))
 }
 
 // Cleanup all contained modules
@@ -296,6 +631,9 @@ func (patch *Patch) Cleanup() {
 	// First call base cleanup
 	patch.BaseModule.Cleanup()
 
+	// Release execution plan
+	patch.schedule = nil
+
 	// Cleanup contained modules
 	for e := patch.Modules.Front(); e != nil; e = e.Next() {
 		module := e.Value.(Module)
@@ -306,31 +644,80 @@ func (patch *Patch) Cleanup() {
 // SendMessage to the patch, look at the first path component from the address,
 // and see if it matches an identifier from the patch modules. If it does, check
 // if the address is completely resolved, if not send the message further down
-// the line, else deliver the message to the module
+// the line, else deliver the message to the module. A pattern component
+// delivers to every matching module, an exact identifier to the first. Named
+// score players of the patch receive transport messages the same way
 func (patch *Patch) SendMessage(address *Address, message Message) {
-	if address.IsValid() {
-		identifier := address.CurrentIdentifier()
+	if !address.IsValid() {
+		return
+	}
+
+	identifier := address.CurrentIdentifier()
+
+	// An empty component matches at any depth, match the rest of the address
+	// in this patch and pass the address on to every module
+	if identifier == "" && !address.IsResolved() {
+		patch.SendMessage(address.next(), message)
 
-		// Loop through all modules
 		for e := patch.Modules.Front(); e != nil; e = e.Next() {
-			module := e.Value.(Module)
-			moduleIdentifier := module.GetIdentifier()
-
-			// check if their identifier matches the first address
-			// component identifier
-			if moduleIdentifier == identifier {
-				if address.IsResolved() {
-					// We found the address, deliver the message
-					module.Message(message)
-				} else {
-					// Go to next component of address
-					address.Next()
-					// Message is not yet on its final destination, pass it on
-					module.SendMessage(address, message)
-				}
+			e.Value.(Module).SendMessage(address, message)
+		}
+
+		return
+	}
 
+	pattern := isPattern(identifier)
+
+	// Loop through all modules
+	for e := patch.Modules.Front(); e != nil; e = e.Next() {
+		module := e.Value.(Module)
+
+		// check if their identifier matches the first address
+		// component identifier
+		if !matchIdentifier(identifier, module.GetIdentifier()) {
+			continue
+		}
+
+		if address.IsResolved() {
+			// We found the address, deliver the message
+			deliverMessage(module, message)
+		} else {
+			// Message is not yet on its final destination, pass it on
+			module.SendMessage(address.next(), message)
+		}
+
+		if !pattern {
+			break
+		}
+	}
+
+	// Score players of this patch are addressed by identifier as well
+	if address.IsResolved() {
+		for e := patch.ScorePlayers.Front(); e != nil; e = e.Next() {
+			player := e.Value.(*ScorePlayer)
+
+			if player.Identifier == "" || !matchIdentifier(identifier, player.Identifier) {
+				continue
+			}
+
+			player.Message(message, patch)
+
+			if !pattern {
 				break
 			}
 		}
 	}
 }
+
+// FindScorePlayer returns the score player with identifier, nil if the patch
+// has no such player
+func (patch *Patch) FindScorePlayer(identifier string) *ScorePlayer {
+	for e := patch.ScorePlayers.Front(); e != nil; e = e.Next() {
+		player := e.Value.(*ScorePlayer)
+		if player.Identifier == identifier {
+			return player
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,794 @@
+package farsounds
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+	"sort"
+)
+
+/*
+	Patterns
+*/
+
+// Pattern generates a stream of values. Patterns that hold other patterns
+// embed them, a child pattern plays until it ends before the parent moves on
+type Pattern interface {
+	// Next value, false when the stream has ended
+	Next(rnd *rand.Rand) (interface{}, bool)
+
+	// Reset the stream to its start
+	Reset()
+}
+
+// constPattern repeats a value forever
+type constPattern struct {
+	value interface{}
+}
+
+func (pattern *constPattern) Next(rnd *rand.Rand) (interface{}, bool) {
+	return pattern.value, true
+}
+
+func (pattern *constPattern) Reset() {}
+
+// limitPattern ends another pattern after length values
+type limitPattern struct {
+	pattern Pattern
+	length  int
+	count   int
+}
+
+func (pattern *limitPattern) Next(rnd *rand.Rand) (interface{}, bool) {
+	if pattern.count >= pattern.length {
+		return nil, false
+	}
+
+	pattern.count++
+
+	return pattern.pattern.Next(rnd)
+}
+
+func (pattern *limitPattern) Reset() {
+	pattern.pattern.Reset()
+	pattern.count = 0
+}
+
+// mapPattern generates maps with a value from every key pattern, it ends when
+// one of them ends. Keys are sorted so random patterns play in the same order
+// every time
+type mapPattern struct {
+	keys   []string
+	values []Pattern
+}
+
+func (pattern *mapPattern) Next(rnd *rand.Rand) (interface{}, bool) {
+	values := make(map[string]interface{}, len(pattern.values))
+
+	for i, p := range pattern.values {
+		value, ok := p.Next(rnd)
+		if !ok {
+			return nil, false
+		}
+
+		values[pattern.keys[i]] = value
+	}
+
+	return values, true
+}
+
+func (pattern *mapPattern) Reset() {
+	for _, p := range pattern.values {
+		p.Reset()
+	}
+}
+
+// listPattern generates lists with a value from every element pattern, it
+// ends when one of them ends
+type listPattern struct {
+	values []Pattern
+}
+
+func (pattern *listPattern) Next(rnd *rand.Rand) (interface{}, bool) {
+	values := make([]interface{}, len(pattern.values))
+
+	for i, p := range pattern.values {
+		value, ok := p.Next(rnd)
+		if !ok {
+			return nil, false
+		}
+
+		values[i] = value
+	}
+
+	return values, true
+}
+
+func (pattern *listPattern) Reset() {
+	for _, p := range pattern.values {
+		p.Reset()
+	}
+}
+
+// embedPattern plays child patterns picked one after another, pick returns
+// false when there are no more children
+type embedPattern struct {
+	pick    func(rnd *rand.Rand) (Pattern, bool)
+	reset   func()
+	current Pattern
+
+	// Number of children, a pattern ends after as many empty children in a
+	// row so it can not loop forever
+	children int
+}
+
+func (pattern *embedPattern) Next(rnd *rand.Rand) (interface{}, bool) {
+	empty := 0
+
+	for {
+		if pattern.current != nil {
+			value, ok := pattern.current.Next(rnd)
+			if ok {
+				return value, true
+			}
+
+			pattern.current = nil
+
+			empty++
+			if empty > pattern.children {
+				return nil, false
+			}
+		}
+
+		child, ok := pattern.pick(rnd)
+		if !ok {
+			return nil, false
+		}
+
+		child.Reset()
+		pattern.current = child
+	}
+}
+
+func (pattern *embedPattern) Reset() {
+	pattern.current = nil
+	pattern.reset()
+}
+
+// newSeqPattern plays values in order, repeats times or forever if repeats is
+// negative, ending after length values if length is not negative
+func newSeqPattern(values []Pattern, repeats int, length int) Pattern {
+	index := 0
+	count := 0
+
+	var pattern Pattern = &embedPattern{
+		pick: func(rnd *rand.Rand) (Pattern, bool) {
+			if len(values) == 0 || (repeats >= 0 && count >= repeats) {
+				return nil, false
+			}
+
+			child := values[index]
+
+			index++
+			if index == len(values) {
+				index = 0
+				count++
+			}
+
+			return child, true
+		},
+		reset: func() {
+			index = 0
+			count = 0
+		},
+		children: len(values),
+	}
+
+	if length >= 0 {
+		pattern = &limitPattern{pattern: pattern, length: length}
+	}
+
+	return pattern
+}
+
+// newChoosePattern plays values picked at random, repeats times or forever if
+// repeats is negative. Values are picked with weights, if there are any
+func newChoosePattern(values []Pattern, weights []float64, repeats int) Pattern {
+	count := 0
+
+	return &embedPattern{
+		pick: func(rnd *rand.Rand) (Pattern, bool) {
+			if len(values) == 0 || (repeats >= 0 && count >= repeats) {
+				return nil, false
+			}
+
+			count++
+
+			return values[weightedIndex(rnd, len(values), weights)], true
+		},
+		reset: func() {
+			count = 0
+		},
+		children: len(values),
+	}
+}
+
+// newMarkovPattern plays values from a Markov chain, transitions holds the
+// weights from every value to the next values. The chain starts at start and
+// plays repeats values, or forever if repeats is negative. A value without
+// transitions ends the chain
+func newMarkovPattern(values []Pattern, transitions [][]float64, start int, repeats int) Pattern {
+	state := -1
+	count := 0
+
+	return &embedPattern{
+		pick: func(rnd *rand.Rand) (Pattern, bool) {
+			if repeats >= 0 && count >= repeats {
+				return nil, false
+			}
+
+			if state < 0 {
+				state = start
+			} else {
+				if state >= len(transitions) || len(transitions[state]) == 0 {
+					return nil, false
+				}
+
+				state = weightedIndex(rnd, len(transitions[state]), transitions[state])
+			}
+
+			if state >= len(values) {
+				return nil, false
+			}
+
+			count++
+
+			return values[state], true
+		},
+		reset: func() {
+			state = -1
+			count = 0
+		},
+		children: len(values),
+	}
+}
+
+// weightedIndex picks an index below n with weights, uniformly if there are
+// no weights for all indices or they add up to zero
+func weightedIndex(rnd *rand.Rand, n int, weights []float64) int {
+	if len(weights) >= n {
+		total := 0.0
+		for _, weight := range weights[:n] {
+			total += math.Max(weight, 0.0)
+		}
+
+		if total > 0.0 {
+			r := rnd.Float64() * total
+
+			for i, weight := range weights[:n] {
+				r -= math.Max(weight, 0.0)
+				if r < 0.0 {
+					return i
+				}
+			}
+
+			// Rounding, pick the last index with a weight
+			for i := n - 1; i >= 0; i-- {
+				if weights[i] > 0.0 {
+					return i
+				}
+			}
+		}
+	}
+
+	return rnd.Intn(n)
+}
+
+// rangePattern generates numbers from a function of the value index, length
+// values or forever if length is negative
+type rangePattern struct {
+	value  func(index int, rnd *rand.Rand) float64
+	length int
+	index  int
+}
+
+func (pattern *rangePattern) Next(rnd *rand.Rand) (interface{}, bool) {
+	if pattern.length >= 0 && pattern.index >= pattern.length {
+		return nil, false
+	}
+
+	value := pattern.value(pattern.index, rnd)
+	pattern.index++
+
+	return value, true
+}
+
+func (pattern *rangePattern) Reset() {
+	pattern.index = 0
+}
+
+/*
+	Pattern scripts
+*/
+
+// NewPattern creates a pattern from a script value. Objects with a "pattern"
+// key are patterns, other objects and lists generate objects and lists with
+// a value from each of their patterns and all other values are constant.
+// Patterns are
+//
+// seq: values in order, repeats times (default 1, negative is forever)
+//
+// series: values in order until length values are played
+//
+// choose: values at random with optional weights, repeats values (default
+// forever)
+//
+// markov: values from a Markov chain, transitions lists the weights from each
+// value to all values, the chain starts at start (default 0) and plays
+// repeats values (default forever)
+//
+// arith: start, start + step, ... or length values from start to end
+//
+// geom: start, start * grow, ... or length values from start to end
+//
+// white: random numbers between low and high
+//
+// euclid: a Euclidean rhythm of 1 for hits and 0 for rests, hits spread over
+// steps and rotated by rotate, repeats times (default forever)
+//
+// Values in seq, series, choose and markov can be patterns. Numeric patterns
+// play length values, or forever if there is no length
+func NewPattern(spec interface{}) (Pattern, error) {
+	switch v := spec.(type) {
+	case map[string]interface{}:
+		if _, ok := v["pattern"]; ok {
+			return newPatternFromSpec(v)
+		}
+
+		keys := make([]string, 0, len(v))
+		for key := range v {
+			keys = append(keys, key)
+		}
+
+		sort.Strings(keys)
+
+		values := make([]Pattern, len(keys))
+
+		for i, key := range keys {
+			pattern, err := NewPattern(v[key])
+			if err != nil {
+				return nil, err
+			}
+
+			values[i] = pattern
+		}
+
+		return &mapPattern{keys: keys, values: values}, nil
+	case []interface{}:
+		values := make([]Pattern, len(v))
+
+		for i, value := range v {
+			pattern, err := NewPattern(value)
+			if err != nil {
+				return nil, err
+			}
+
+			values[i] = pattern
+		}
+
+		return &listPattern{values: values}, nil
+	}
+
+	return &constPattern{value: spec}, nil
+}
+
+// newPatternValues creates the patterns of a values list, values that are not
+// patterns are played once
+func newPatternValues(spec map[string]interface{}) ([]Pattern, error) {
+	list, ok := spec["values"].([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("Pattern %v needs values", spec["pattern"])
+	}
+
+	values := make([]Pattern, len(list))
+
+	for i, value := range list {
+		pattern, err := NewPattern(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if valueMap, ok := value.(map[string]interface{}); !ok || valueMap["pattern"] == nil {
+			pattern = &limitPattern{pattern: pattern, length: 1}
+		}
+
+		values[i] = pattern
+	}
+
+	return values, nil
+}
+
+// patternNumber returns a number from a pattern spec, or def if it is missing
+func patternNumber(spec map[string]interface{}, key string, def float64) (float64, error) {
+	value, ok := spec[key]
+	if !ok {
+		return def, nil
+	}
+
+	number, ok := value.(float64)
+	if !ok {
+		return 0.0, fmt.Errorf("Pattern %v %v must be a number", spec["pattern"], key)
+	}
+
+	return number, nil
+}
+
+// patternWeights returns a list of numbers from a pattern spec
+func patternWeights(spec map[string]interface{}, value interface{}) ([]float64, error) {
+	if value == nil {
+		return nil, nil
+	}
+
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Pattern %v weights must be a list of numbers", spec["pattern"])
+	}
+
+	weights := make([]float64, len(list))
+
+	for i, v := range list {
+		weight, ok := v.(float64)
+		if !ok {
+			return nil, fmt.Errorf("Pattern %v weights must be a list of numbers", spec["pattern"])
+		}
+
+		weights[i] = weight
+	}
+
+	return weights, nil
+}
+
+// newPatternFromSpec creates a pattern from an object with a "pattern" key
+func newPatternFromSpec(spec map[string]interface{}) (Pattern, error) {
+	var numbers = map[string]float64{}
+
+	// Numeric settings of all patterns
+	for _, setting := range []struct {
+		key string
+		def float64
+	}{
+		{"repeats", -1.0}, {"length", -1.0}, {"start", 0.0}, {"step", 1.0},
+		{"grow", 2.0}, {"low", 0.0}, {"high", 1.0}, {"hits", 0.0},
+		{"steps", 0.0}, {"rotate", 0.0},
+	} {
+		value, err := patternNumber(spec, setting.key, setting.def)
+		if err != nil {
+			return nil, err
+		}
+
+		numbers[setting.key] = value
+	}
+
+	repeats := int(numbers["repeats"])
+	length := int(numbers["length"])
+
+	switch spec["pattern"] {
+	case "seq":
+		values, err := newPatternValues(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, ok := spec["repeats"]; !ok {
+			repeats = 1
+		}
+
+		return newSeqPattern(values, repeats, -1), nil
+	case "series":
+		values, err := newPatternValues(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		return newSeqPattern(values, -1, length), nil
+	case "choose":
+		values, err := newPatternValues(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		weights, err := patternWeights(spec, spec["weights"])
+		if err != nil {
+			return nil, err
+		}
+
+		return newChoosePattern(values, weights, repeats), nil
+	case "markov":
+		values, err := newPatternValues(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		rows, ok := spec["transitions"].([]interface{})
+		if !ok || len(rows) != len(values) {
+			return nil, errors.New("Pattern markov needs transitions for every value")
+		}
+
+		transitions := make([][]float64, len(rows))
+
+		for i, row := range rows {
+			transitions[i], err = patternWeights(spec, row)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		start := int(numbers["start"])
+		if start < 0 || start >= len(values) {
+			return nil, fmt.Errorf("Pattern markov start %v is not a value", start)
+		}
+
+		return newMarkovPattern(values, transitions, start, repeats), nil
+	case "arith", "geom":
+		start := numbers["start"]
+		step := numbers["step"]
+		exponential := spec["pattern"] == "geom"
+
+		if exponential {
+			step = numbers["grow"]
+		}
+
+		if end, ok := spec["end"]; ok {
+			to, ok := end.(float64)
+			if !ok || length < 2 {
+				return nil, fmt.Errorf("Pattern %v with an end needs a number end and a length of at least 2", spec["pattern"])
+			}
+
+			if exponential {
+				if start*to <= 0.0 {
+					return nil, errors.New("Pattern geom start and end must be non zero with the same sign")
+				}
+
+				step = math.Pow(to/start, 1.0/float64(length-1))
+			} else {
+				step = (to - start) / float64(length-1)
+			}
+		}
+
+		return &rangePattern{
+			value: func(index int, rnd *rand.Rand) float64 {
+				if exponential {
+					return start * math.Pow(step, float64(index))
+				}
+
+				return start + step*float64(index)
+			},
+			length: length,
+		}, nil
+	case "white":
+		low := numbers["low"]
+		high := numbers["high"]
+
+		return &rangePattern{
+			value: func(index int, rnd *rand.Rand) float64 {
+				return low + rnd.Float64()*(high-low)
+			},
+			length: length,
+		}, nil
+	case "euclid":
+		hits := int(numbers["hits"])
+		steps := int(numbers["steps"])
+		rotate := int(numbers["rotate"])
+
+		if steps < 1 || hits < 0 || hits > steps {
+			return nil, errors.New("Pattern euclid needs steps and at most steps hits")
+		}
+
+		if repeats >= 0 {
+			length = repeats * steps
+		}
+
+		return &rangePattern{
+			value: func(index int, rnd *rand.Rand) float64 {
+				i := ((index+rotate)%steps + steps) % steps
+				if (i*hits)%steps < hits {
+					return 1.0
+				}
+
+				return 0.0
+			},
+			length: length,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("Unknown pattern %v", spec["pattern"])
+}
+
+/*
+	Pattern streams
+*/
+
+// PatternStream generates score events from patterns, in the style of a
+// SuperCollider Pbind. Every event sends a message to an address, both can
+// hold patterns, and is followed by the next event after dur. An event is a
+// rest if gate is 0 or false, or at random with probability. The stream
+// ends when one of its patterns ends or after length. Times are in beats in
+// scores with a tempo, in seconds otherwise
+type PatternStream struct {
+	address     Pattern
+	message     Pattern
+	dur         Pattern
+	gate        Pattern
+	probability Pattern
+
+	// Length of the stream, negative has no end
+	length float64
+
+	seed int64
+	rnd  *rand.Rand
+	time float64
+}
+
+// NewPatternStream creates a pattern stream from a script with an address,
+// message, dur, gate, probability and length. The random patterns of the
+// stream are generated from seed, so a stream can be reproduced
+func NewPatternStream(payload interface{}, seed int64) (*PatternStream, error) {
+	values, ok := payload.(map[string]interface{})
+	if !ok || values["address"] == nil || values["message"] == nil || values["dur"] == nil {
+		return nil, errors.New("Pattern stream needs an address, message and dur")
+	}
+
+	stream := PatternStream{
+		length: -1.0,
+		seed:   seed,
+	}
+
+	if length, ok := values["length"]; ok {
+		stream.length, ok = length.(float64)
+		if !ok {
+			return nil, errors.New("Pattern stream length must be a number")
+		}
+	}
+
+	for _, p := range []struct {
+		pattern *Pattern
+		key     string
+		def     interface{}
+	}{
+		{&stream.address, "address", nil},
+		{&stream.message, "message", nil},
+		{&stream.dur, "dur", nil},
+		{&stream.gate, "gate", 1.0},
+		{&stream.probability, "probability", 1.0},
+	} {
+		spec, ok := values[p.key]
+		if !ok {
+			spec = p.def
+		}
+
+		pattern, err := NewPattern(spec)
+		if err != nil {
+			return nil, err
+		}
+
+		*p.pattern = pattern
+	}
+
+	stream.Reset()
+
+	return &stream, nil
+}
+
+// Reset the stream to its start, it generates the same events again
+func (stream *PatternStream) Reset() {
+	stream.rnd = rand.New(rand.NewSource(stream.seed))
+	stream.time = 0.0
+
+	for _, pattern := range []Pattern{stream.address, stream.message, stream.dur, stream.gate, stream.probability} {
+		pattern.Reset()
+	}
+}
+
+// Next returns the next event, with On the time from the start of the stream,
+// or nil when the stream has ended. Rests are events without an action
+func (stream *PatternStream) Next() *ScoreEvent {
+	if stream.length >= 0.0 && stream.time >= stream.length {
+		return nil
+	}
+
+	var values [5]interface{}
+
+	for i, pattern := range []Pattern{stream.address, stream.message, stream.dur, stream.gate, stream.probability} {
+		value, ok := pattern.Next(stream.rnd)
+		if !ok {
+			return nil
+		}
+
+		values[i] = value
+	}
+
+	address, ok := values[0].(string)
+	if !ok {
+		return nil
+	}
+
+	// Events must move forward in time
+	dur, ok := values[2].(float64)
+	if !ok || dur <= 0.0 {
+		return nil
+	}
+
+	event := &ScoreEvent{On: stream.time}
+	stream.time += dur
+
+	switch gate := values[3].(type) {
+	case float64:
+		if gate == 0.0 {
+			return event
+		}
+	case bool:
+		if !gate {
+			return event
+		}
+	}
+
+	if probability, ok := values[4].(float64); ok && stream.rnd.Float64() >= probability {
+		return event
+	}
+
+	event.Action = &ScoreSendAction{
+		Deliveries: []*ScoreDelivery{{Address: address, Message: values[1]}},
+	}
+
+	return event
+}
+
+/*
+	Score pattern action
+*/
+
+// ScorePatternAction starts a pattern stream, see PatternStream. The events of
+// the stream are played from the time of the action next to the events of the
+// score, until the stream ends or the player stops
+type ScorePatternAction struct {
+	// Pattern stream script
+	Payload interface{}
+
+	// Random seed of the stream
+	Seed int64
+}
+
+// NewScorePatternAction new pattern action from a pattern stream payload, the
+// payload seed makes the stream reproducible, without it a seed is picked when
+// the action is created
+func NewScorePatternAction(payload interface{}) (*ScorePatternAction, error) {
+	action := ScorePatternAction{Payload: payload}
+
+	if values, ok := payload.(map[string]interface{}); ok {
+		if seed, ok := values["seed"].(float64); ok {
+			action.Seed = int64(seed)
+		} else {
+			// Seeds fit in a script number, so saved scores play the same
+			action.Seed = rand.Int63n(1 << 53)
+		}
+	}
+
+	// Validate the payload
+	_, err := NewPatternStream(payload, action.Seed)
+	if err != nil {
+		return nil, err
+	}
+
+	return &action, nil
+}
+
+// Action pattern, starts a new stream in the player
+func (action *ScorePatternAction) Action(player *ScorePlayer, module Module, time *float64) {
+	stream, err := NewPatternStream(action.Payload, action.Seed)
+	if err != nil {
+		return
+	}
+
+	player.startStream(stream, *time)
+}
@@ -4,6 +4,7 @@ import (
 	"container/list"
 	"errors"
 	"fmt"
+	"math"
 )
 
 /*
@@ -30,6 +31,19 @@ type VoiceModule interface {
 	Voice
 }
 
+// TimedVoice is implemented by voices that can turn off at a sample offset
+// within their next DSP block, other voices get their note off at the start
+// of the block
+type TimedVoice interface {
+	NoteOffAt(offset int32)
+}
+
+// UpdatableVoice is implemented by voices that can change their settings
+// while they sound
+type UpdatableVoice interface {
+	Update(settings interface{})
+}
+
 /*
 	Poly factory and module
 */
@@ -53,12 +67,62 @@ type PolyVoiceModule struct {
 
 	// Used voice pool
 	UsedVoicePool *list.List
+
+	// Process voices in parallel on the shared worker pool, the output is
+	// bit-identical to serial processing
+	Parallel bool
+
+	// Voices processed in the current DSP cycle
+	activeVoices []*polyVoiceInstance
+
+	// Maximum number of sounding voices, 0 for no limit. Voices that fade out
+	// after they are stolen do not count
+	MaxVoices int
+
+	// Policy to free a voice when MaxVoices are sounding: "oldest" (default),
+	// "quietest", "lowest" or "highest" pitch, or "refuse" to drop the new
+	// note. Voices that are already released are stolen first
+	StealPolicy string
+
+	// Fade out time of a stolen voice in seconds
+	StealFade float64
+
+	// ID of the last started voice
+	lastVoiceID int64
 }
 
+// Default fade out time of stolen voices in seconds
+const defaultStealFade = 0.005
+
 type polyVoiceInstance struct {
 	voice            VoiceModule
 	sampsTillNoteOff int64
 	noteOffSend      bool
+
+	// Voice output is delayed by the sample offset of the note on, the
+	// last delay samples of every voice block are carried to the next block
+	delay int32
+	carry []Buffer
+
+	// Key the voice is addressed with by messages, nil if none
+	key interface{}
+
+	// Unique ID of the note, returned by StartVoice
+	id int64
+
+	// Voice was stopped before its duration ended
+	released bool
+
+	// Pitch from the frequency or note setting, used by the steal policies
+	pitch float64
+
+	// Mean absolute output of the last block, used by the steal policies
+	level float64
+
+	// Samples left of the fade out of a stolen voice, and the fade length
+	stolen     bool
+	fadeLeft   int64
+	fadeLength int64
 }
 
 /*
@@ -74,6 +138,7 @@ func NewPolyVoiceModule(factory PolyVoiceFactory, numOutlets int, buflen int32,
 	polyVoiceModule.FreeVoicePool = list.New()
 	polyVoiceModule.UsedVoicePool = list.New()
 	polyVoiceModule.Factory = factory
+	polyVoiceModule.StealFade = defaultStealFade
 	return polyVoiceModule
 }
 
@@ -96,6 +161,27 @@ func PolyVoiceModuleFactory(settings interface{}, buflen int32, sr float64) (Mod
 
 	module := NewPolyVoiceModule(entry.Factory, entry.NumOutlets, buflen, sr)
 
+	if parallel, ok := factorySettings["parallel"].(bool); ok {
+		module.Parallel = parallel
+	}
+
+	if maxVoices, ok := factorySettings["maxVoices"].(float64); ok {
+		module.MaxVoices = int(maxVoices)
+	}
+
+	if steal, ok := factorySettings["steal"].(string); ok {
+		switch steal {
+		case "oldest", "quietest", "lowest", "highest", "refuse":
+			module.StealPolicy = steal
+		default:
+			return nil, fmt.Errorf("Unknown steal policy %v for poly voice", steal)
+		}
+	}
+
+	if stealFade, ok := factorySettings["stealFade"].(float64); ok {
+		module.StealFade = stealFade
+	}
+
 	return module, nil
 }
 
@@ -152,53 +238,260 @@ func (module *PolyVoiceModule) DSP(timestamp int64) {
 		}
 	}
 
-	// Loop through voice modules
+	// Collect active voices, move finished voices to the free pool
+	active := module.activeVoices[:0]
+
 	for elem := module.UsedVoicePool.Front(); elem != nil; {
 		instance := elem.Value.(*polyVoiceInstance)
-		voice := instance.voice
 
 		// Set temp elem, so we can savely remove elem from list
 		tmpElem := elem
 		elem = elem.Next()
 
-		if voice.IsFinished() {
+		if instance.stolen && instance.fadeLeft <= 0 {
+			// The carry of a stolen voice is faded out
+			instance.stolen = false
+			instance.delay = 0
+			module.UsedVoicePool.Remove(tmpElem)
+			module.FreeVoicePool.PushBack(instance)
+		} else if instance.voice.IsFinished() {
+			module.flushCarry(instance)
 			module.UsedVoicePool.Remove(tmpElem)
 			module.FreeVoicePool.PushBack(instance)
 		} else {
+			active = append(active, instance)
+		}
+	}
+
+	module.activeVoices = active
+
+	// Note offs that are due in this block of the voice
+	for _, instance := range active {
+		if instance.noteOffSend || instance.sampsTillNoteOff >= int64(buflen) {
+			continue
+		}
+
+		if timedVoice, ok := instance.voice.(TimedVoice); ok {
+			offset := instance.sampsTillNoteOff
+			if offset < 0 {
+				offset = 0
+			}
+
+			timedVoice.NoteOffAt(int32(offset))
+			instance.noteOffSend = true
+		} else if instance.sampsTillNoteOff <= 0 {
+			instance.voice.NoteOff()
+			instance.noteOffSend = true
+		}
+	}
+
+	// Perform voice DSP, voices are independent so they can run in parallel
+	if module.Parallel && len(active) > 1 {
+		getWorkerPool().run(len(active), func(i int) {
+			voice := active[i].voice
 			voice.PrepareDSP()
 			voice.RequestDSP(timestamp)
+		})
+	} else {
+		for _, instance := range active {
+			instance.voice.PrepareDSP()
+			instance.voice.RequestDSP(timestamp)
+		}
+	}
 
-			for outletIndex, voiceOutlet := range voice.GetOutlets() {
-				voiceBuffer := voiceOutlet.Buffer
-				polyBuffer := module.Outlets[outletIndex].Buffer
+	// Sum voice outputs in a fixed order, so output is deterministic
+	for _, instance := range active {
+		voice := instance.voice
+		delay := instance.delay
 
+		if module.MaxVoices > 0 {
+			instance.level = voiceLevel(voice)
+		}
+
+		if instance.stolen {
+			module.sumFade(instance)
+			continue
+		}
+
+		for outletIndex, voiceOutlet := range voice.GetOutlets() {
+			voiceBuffer := voiceOutlet.Buffer
+			polyBuffer := module.Outlets[outletIndex].Buffer
+
+			if delay == 0 {
 				for i := int32(0); i < buflen; i++ {
 					polyBuffer[i] += voiceBuffer[i]
 				}
+
+				continue
 			}
 
-			if !instance.noteOffSend {
-				instance.sampsTillNoteOff -= int64(buflen)
-				if instance.sampsTillNoteOff <= 0 {
-					voice.NoteOff()
-					instance.noteOffSend = true
-				}
+			carry := instance.carry[outletIndex]
+
+			for i := int32(0); i < delay; i++ {
+				polyBuffer[i] += carry[i]
 			}
+
+			for i := delay; i < buflen; i++ {
+				polyBuffer[i] += voiceBuffer[i-delay]
+			}
+
+			copy(carry, voiceBuffer[buflen-delay:])
+		}
+
+		if !instance.noteOffSend {
+			instance.sampsTillNoteOff -= int64(buflen)
+		}
+	}
+}
+
+// sumFade adds the output of a stolen voice with a linear fade out
+func (module *PolyVoiceModule) sumFade(instance *polyVoiceInstance) {
+	buflen := module.GetBufferLength()
+	delay := instance.delay
+
+	for outletIndex, voiceOutlet := range instance.voice.GetOutlets() {
+		voiceBuffer := voiceOutlet.Buffer
+		polyBuffer := module.Outlets[outletIndex].Buffer
+
+		var carry Buffer
+		if delay > 0 {
+			carry = instance.carry[outletIndex]
+		}
+
+		for i := int32(0); i < buflen; i++ {
+			gain := float64(instance.fadeLeft-int64(i)) / float64(instance.fadeLength)
+			if gain <= 0.0 {
+				break
+			}
+
+			if i < delay {
+				polyBuffer[i] += carry[i] * gain
+			} else {
+				polyBuffer[i] += voiceBuffer[i-delay] * gain
+			}
+		}
+
+		if delay > 0 {
+			copy(carry, voiceBuffer[buflen-delay:])
+		}
+	}
+
+	instance.fadeLeft -= int64(buflen)
+}
+
+// voiceLevel returns the mean absolute output of the last block of a voice
+func voiceLevel(voice VoiceModule) float64 {
+	level := 0.0
+	numSamples := 0
+
+	for _, outlet := range voice.GetOutlets() {
+		for _, sample := range outlet.Buffer {
+			level += math.Abs(sample)
+		}
+
+		numSamples += len(outlet.Buffer)
+	}
+
+	if numSamples == 0 {
+		return 0.0
+	}
+
+	return level / float64(numSamples)
+}
+
+// flushCarry adds the samples carried from the last block of a finished voice
+// to the output
+func (module *PolyVoiceModule) flushCarry(instance *polyVoiceInstance) {
+	for outletIndex, carry := range instance.carry {
+		polyBuffer := module.Outlets[outletIndex].Buffer
+
+		for i := int32(0); i < instance.delay; i++ {
+			polyBuffer[i] += carry[i]
+		}
+	}
+
+	instance.delay = 0
+}
+
+// FastForward counts down note offs without performing voice DSP. Voices that
+// support it are fast forwarded, other voices can not finish their release
+// and are freed as soon as they get a note off
+func (module *PolyVoiceModule) FastForward(timestamp int64) {
+	buflen := int64(module.GetBufferLength())
+
+	for elem := module.UsedVoicePool.Front(); elem != nil; {
+		instance := elem.Value.(*polyVoiceInstance)
+
+		// Set temp elem, so we can savely remove elem from list
+		tmpElem := elem
+		elem = elem.Next()
+
+		fastForwarder, canFastForward := instance.voice.(FastForwarder)
+		if canFastForward {
+			fastForwarder.FastForward(timestamp)
+		}
+
+		if !instance.noteOffSend {
+			instance.sampsTillNoteOff -= buflen
+			if instance.sampsTillNoteOff <= 0 {
+				instance.voice.NoteOff()
+				instance.noteOffSend = true
+			}
+		}
+
+		if instance.stolen || instance.voice.IsFinished() || (instance.noteOffSend && !canFastForward) {
+			instance.stolen = false
+			instance.delay = 0
+			module.UsedVoicePool.Remove(tmpElem)
+			module.FreeVoicePool.PushBack(instance)
 		}
 	}
 }
 
-// Message to module
+// Message to module, the voice starts at the start of the next block
 func (module *PolyVoiceModule) Message(message Message) {
-	sr := module.GetSampleRate()
+	module.MessageAt(message, 0)
+}
 
+// MessageAt starts, stops or updates voices at a sample offset within the next
+// block. Voices are addressed by a key, any number or string chosen by the
+// sender, for example a voice ID or a pitch. {"duration", "settings"} plays a
+// voice for duration seconds, with an optional "key". {"noteOn": key,
+// "settings"} starts an open ended voice, {"noteOff": key} stops the voices
+// with key, {"update": key, "settings"} changes the settings of the voices
+// with key and {"allNotesOff": true} stops all voices. Messages with a key
+// that is not a number or string are ignored
+func (module *PolyVoiceModule) MessageAt(message Message, offset int32) {
 	valueMap, ok := message.(map[string]interface{})
 	if !ok {
 		return
 	}
 
-	duration, ok := valueMap["duration"].(float64)
-	if !ok {
+	// Keys are compared, lists and objects would panic
+	for _, name := range []string{"noteOff", "update", "noteOn", "key"} {
+		if key, ok := valueMap[name]; ok && !isVoiceKey(key) {
+			return
+		}
+	}
+
+	if key, ok := valueMap["noteOff"]; ok {
+		module.releaseVoices(offset, func(instance *polyVoiceInstance) bool {
+			return instance.key == key
+		})
+
+		return
+	}
+
+	if key, ok := valueMap["update"]; ok {
+		module.updateVoices(valueMap["settings"], func(instance *polyVoiceInstance) bool {
+			return instance.key == key
+		})
+
+		return
+	}
+
+	if _, ok := valueMap["allNotesOff"]; ok {
+		module.AllNotesOff(offset)
 		return
 	}
 
@@ -207,10 +500,238 @@ func (module *PolyVoiceModule) Message(message Message) {
 		return
 	}
 
+	if key, ok := valueMap["noteOn"]; ok {
+		module.StartVoice(key, -1.0, settings, offset)
+		return
+	}
+
+	if duration, ok := valueMap["duration"].(float64); ok {
+		module.StartVoice(valueMap["key"], duration, settings, offset)
+	}
+}
+
+// isVoiceKey returns true if key is a number or string, the keys of messages
+func isVoiceKey(key interface{}) bool {
+	switch key.(type) {
+	case float64, string:
+		return true
+	}
+
+	return false
+}
+
+// StartVoice starts a voice at a sample offset within the next block and
+// returns its ID. The voice stops after duration seconds, or is open ended if
+// duration is negative. A non nil key makes the voice addressable by messages,
+// keys must be comparable.
+// If MaxVoices are sounding a voice is stolen, or 0 is returned if the steal
+// policy refuses new voices
+func (module *PolyVoiceModule) StartVoice(key interface{}, duration float64, settings interface{}, offset int32) int64 {
+	sr := module.GetSampleRate()
+
+	if module.MaxVoices > 0 && module.numSoundingVoices() >= module.MaxVoices {
+		victim := module.stealCandidate()
+		if victim == nil {
+			return 0
+		}
+
+		module.steal(victim)
+	}
+
 	sampsTillNoteOff := int64(sr * duration)
+	if duration < 0.0 {
+		duration = 0.0
+		sampsTillNoteOff = math.MaxInt64
+	}
+
+	module.lastVoiceID++
 
 	instance := module.getFreeVoice()
 	instance.voice.NoteOn(duration, sr, settings)
 	instance.noteOffSend = false
+	instance.released = false
+	instance.stolen = false
 	instance.sampsTillNoteOff = sampsTillNoteOff
+	instance.delay = offset
+	instance.key = key
+	instance.id = module.lastVoiceID
+	instance.pitch = voicePitch(settings)
+	instance.level = 0.0
+
+	if offset > 0 {
+		if instance.carry == nil {
+			instance.carry = make([]Buffer, len(instance.voice.GetOutlets()))
+			for i := range instance.carry {
+				instance.carry[i] = make(Buffer, module.GetBufferLength())
+			}
+		}
+
+		for _, carry := range instance.carry {
+			for i := range carry {
+				carry[i] = 0.0
+			}
+		}
+	}
+
+	return instance.id
+}
+
+// numSoundingVoices returns the number of used voices that are not stolen
+func (module *PolyVoiceModule) numSoundingVoices() int {
+	n := 0
+
+	for elem := module.UsedVoicePool.Front(); elem != nil; elem = elem.Next() {
+		if !elem.Value.(*polyVoiceInstance).stolen {
+			n++
+		}
+	}
+
+	return n
+}
+
+// stealCandidate returns the voice to steal by the steal policy, released
+// voices come first. Nil is returned if the policy refuses new voices
+func (module *PolyVoiceModule) stealCandidate() *polyVoiceInstance {
+	if module.StealPolicy == "refuse" {
+		return nil
+	}
+
+	var candidate *polyVoiceInstance
+
+	for elem := module.UsedVoicePool.Front(); elem != nil; elem = elem.Next() {
+		instance := elem.Value.(*polyVoiceInstance)
+
+		if instance.stolen {
+			continue
+		}
+
+		if candidate == nil || module.stealBefore(instance, candidate) {
+			candidate = instance
+		}
+	}
+
+	return candidate
+}
+
+// stealBefore returns true if voice a should be stolen before voice b
+func (module *PolyVoiceModule) stealBefore(a *polyVoiceInstance, b *polyVoiceInstance) bool {
+	aReleased := a.released || a.noteOffSend
+	bReleased := b.released || b.noteOffSend
+
+	if aReleased != bReleased {
+		return aReleased
+	}
+
+	switch module.StealPolicy {
+	case "quietest":
+		if a.level != b.level {
+			return a.level < b.level
+		}
+	case "lowest":
+		if a.pitch != b.pitch {
+			return a.pitch < b.pitch
+		}
+	case "highest":
+		if a.pitch != b.pitch {
+			return a.pitch > b.pitch
+		}
+	}
+
+	// Oldest first
+	return a.id < b.id
+}
+
+// steal fades out a voice, it can no longer be addressed
+func (module *PolyVoiceModule) steal(instance *polyVoiceInstance) {
+	fadeLength := int64(module.StealFade * module.GetSampleRate())
+	if fadeLength < 1 {
+		fadeLength = 1
+	}
+
+	instance.stolen = true
+	instance.released = true
+	instance.key = nil
+	instance.fadeLeft = fadeLength
+	instance.fadeLength = fadeLength
+}
+
+// voicePitch returns the frequency of the voice settings, from "frequency" or
+// the MIDI "note", 0 if unknown
+func voicePitch(settings interface{}) float64 {
+	settingsMap, ok := settings.(map[string]interface{})
+	if !ok {
+		return 0.0
+	}
+
+	if frequency, ok := settingsMap["frequency"].(float64); ok {
+		return frequency
+	}
+
+	if note, ok := settingsMap["note"].(float64); ok {
+		return midiNoteFrequency(int(note))
+	}
+
+	return 0.0
+}
+
+// StopVoice stops the voice with id at a sample offset within the next block
+func (module *PolyVoiceModule) StopVoice(id int64, offset int32) {
+	module.releaseVoices(offset, func(instance *polyVoiceInstance) bool {
+		return instance.id == id
+	})
+}
+
+// UpdateVoice changes the settings of the voice with id, voices must
+// implement UpdatableVoice
+func (module *PolyVoiceModule) UpdateVoice(id int64, settings interface{}) {
+	module.updateVoices(settings, func(instance *polyVoiceInstance) bool {
+		return instance.id == id
+	})
+}
+
+// AllNotesOff stops all voices at a sample offset within the next block
+func (module *PolyVoiceModule) AllNotesOff(offset int32) {
+	module.releaseVoices(offset, func(instance *polyVoiceInstance) bool {
+		return true
+	})
+}
+
+// releaseVoices stops the matching voices at a sample offset within the next
+// block. Voice output is delayed by the offset of its note on, so the note off
+// is due at offset minus that delay in the block of the voice
+func (module *PolyVoiceModule) releaseVoices(offset int32, match func(instance *polyVoiceInstance) bool) {
+	for elem := module.UsedVoicePool.Front(); elem != nil; elem = elem.Next() {
+		instance := elem.Value.(*polyVoiceInstance)
+
+		if instance.released || instance.noteOffSend || !match(instance) {
+			continue
+		}
+
+		instance.released = true
+
+		sampsTillNoteOff := int64(offset - instance.delay)
+		if sampsTillNoteOff < 0 {
+			sampsTillNoteOff = 0
+		}
+
+		if sampsTillNoteOff < instance.sampsTillNoteOff {
+			instance.sampsTillNoteOff = sampsTillNoteOff
+		}
+	}
+}
+
+// updateVoices changes the settings of the matching voices that are still
+// sounding, including voices in their release
+func (module *PolyVoiceModule) updateVoices(settings interface{}, match func(instance *polyVoiceInstance) bool) {
+	for elem := module.UsedVoicePool.Front(); elem != nil; elem = elem.Next() {
+		instance := elem.Value.(*polyVoiceInstance)
+
+		if instance.voice.IsFinished() || !match(instance) {
+			continue
+		}
+
+		if updatableVoice, ok := instance.voice.(UpdatableVoice); ok {
+			updatableVoice.Update(settings)
+		}
+	}
 }
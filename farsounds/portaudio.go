@@ -1,6 +1,13 @@
+//go:build cgo
+// +build cgo
+
 package farsounds
 
-import "github.com/gordonklaus/portaudio"
+import (
+	"sync/atomic"
+
+	"github.com/gordonklaus/portaudio"
+)
 
 // PatchStream for port audio
 type PatchStream struct {
@@ -8,12 +15,21 @@ type PatchStream struct {
 	patch     *Patch
 	timestamp int64
 	inlets    []*Inlet
+	controls  []StreamControl
+	messages  *MessageQueue
+}
+
+// StreamControl delivers control input, like MIDI, to the patch of a stream.
+// Dispatch is called on the audio thread at the start of every block
+type StreamControl interface {
+	Dispatch(patch Module, timestamp int64)
 }
 
 // NewPatchStream new patch stream
 func NewPatchStream(patch *Patch) (*PatchStream, error) {
 	patchStream := new(PatchStream)
 	patchStream.patch = patch
+	patchStream.messages = NewMessageQueue(defaultMessageQueueCapacity)
 
 	buflen := patch.BufferLength
 	numInlets := len(patch.Inlets)
@@ -44,6 +60,31 @@ func NewPatchStream(patch *Patch) (*PatchStream, error) {
 	return patchStream, nil
 }
 
+// AddControl adds control input to the stream, add controls before the
+// stream is started
+func (stream *PatchStream) AddControl(control StreamControl) {
+	stream.controls = append(stream.controls, control)
+}
+
+// SendMessage sends a message to the patch at the start of the next block,
+// it is safe to call while the stream runs. Only one goroutine may send
+// messages, it returns false if the message queue is full
+func (stream *PatchStream) SendMessage(address string, message Message) bool {
+	return stream.messages.Push(address, message)
+}
+
+// SendMessageAt sends a message to the patch at a sample timestamp, see
+// SendMessage
+func (stream *PatchStream) SendMessageAt(address string, message Message, timestamp int64) bool {
+	return stream.messages.PushAt(address, message, timestamp)
+}
+
+// Timestamp returns the sample timestamp of the next block, it is safe to call
+// while the stream runs
+func (stream *PatchStream) Timestamp() int64 {
+	return atomic.LoadInt64(&stream.timestamp)
+}
+
 func (stream *PatchStream) processAudio(in, out [][]float32) {
 	buflen := stream.patch.BufferLength
 	outlets := stream.patch.Outlets
@@ -57,8 +98,16 @@ func (stream *PatchStream) processAudio(in, out [][]float32) {
 		}
 	}
 
+	timestamp := stream.timestamp
+
+	stream.messages.Deliver(stream.patch, timestamp)
+
+	for _, control := range stream.controls {
+		control.Dispatch(stream.patch, timestamp)
+	}
+
 	stream.patch.PrepareDSP()
-	stream.patch.RequestDSP(stream.timestamp)
+	stream.patch.RequestDSP(timestamp)
 
 	for i := int32(0); i < buflen; i++ {
 		for j := 0; j < len(outlets); j++ {
@@ -66,5 +115,5 @@ func (stream *PatchStream) processAudio(in, out [][]float32) {
 		}
 	}
 
-	stream.timestamp += int64(buflen)
+	atomic.StoreInt64(&stream.timestamp, timestamp+int64(buflen))
 }
@@ -2,6 +2,7 @@ package farsounds
 
 import (
 	"fmt"
+	"sync"
 )
 
 // ModuleFactory is the module generator function for a factory
@@ -14,6 +15,9 @@ type PolyVoiceFactoryEntry struct {
 }
 
 type registry struct {
+	// Guards the maps, modules can be created from parallel schedules
+	mutex sync.RWMutex
+
 	moduleFactories  map[string]ModuleFactory
 	waveTables       map[string]WaveTable
 	voiceFactories   map[string]*PolyVoiceFactoryEntry
@@ -34,6 +38,9 @@ var Registry = &registry{
 
 // RegisterPolyVoiceFactory register a poly voice factory function
 func (registry *registry) RegisterPolyVoiceFactory(factoryName string, factory PolyVoiceFactory, numOutlets int) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
 	registry.voiceFactories[factoryName] = &PolyVoiceFactoryEntry{
 		Factory:    factory,
 		NumOutlets: numOutlets,
@@ -42,6 +49,9 @@ func (registry *registry) RegisterPolyVoiceFactory(factoryName string, factory P
 
 // GetPolyVoiceFactory get poly voice factory
 func (registry *registry) GetPolyVoiceFactoryEntry(factoryName string) *PolyVoiceFactoryEntry {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
 	return registry.voiceFactories[factoryName]
 }
 
@@ -51,12 +61,19 @@ func (registry *registry) GetPolyVoiceFactoryEntry(factoryName string) *PolyVoic
 
 // RegisterModuleFactory register a module factory function
 func (registry *registry) RegisterModuleFactory(factoryName string, factory ModuleFactory) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
 	registry.moduleFactories[factoryName] = factory
 }
 
 // NewModule create a new module from a factory
 func (registry *registry) NewModule(factoryName string, identifier string, settings interface{}, buflen int32, sr float64) (Module, error) {
-	if factory, ok := registry.moduleFactories[factoryName]; ok {
+	registry.mutex.RLock()
+	factory, ok := registry.moduleFactories[factoryName]
+	registry.mutex.RUnlock()
+
+	if ok {
 		module, err := factory(settings, buflen, sr)
 		if err != nil {
 			return nil, err
@@ -76,11 +93,17 @@ func (registry *registry) NewModule(factoryName string, identifier string, setti
 
 // RegisterWaveTable register a wave table
 func (registry *registry) RegisterWaveTable(waveTableName string, waveTable WaveTable) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
 	registry.waveTables[waveTableName] = waveTable
 }
 
 // GetWaveTable get wave table from registry by name
 func (registry *registry) GetWaveTable(waveTableName string) (WaveTable, error) {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
 	if waveTable, ok := registry.waveTables[waveTableName]; ok {
 		return waveTable, nil
 	}
@@ -94,10 +117,16 @@ func (registry *registry) GetWaveTable(waveTableName string) (WaveTable, error)
 
 // RegisterSoundFileBuffer register sound file buffer
 func (registry *registry) RegisterSoundFileBuffer(bufferName string, buffer *SoundFileBuffer) {
+	registry.mutex.Lock()
+	defer registry.mutex.Unlock()
+
 	registry.soundFileBuffers[bufferName] = buffer
 }
 
 // GetSoundFileBuffer get sound file buffer
 func (registry *registry) GetSoundFileBuffer(bufferName string) *SoundFileBuffer {
+	registry.mutex.RLock()
+	defer registry.mutex.RUnlock()
+
 	return registry.soundFileBuffers[bufferName]
 }
@@ -0,0 +1,419 @@
+package farsounds
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+)
+
+/*
+	Render options
+*/
+
+// RenderOptions control how the outlets of a module are rendered to sound files
+type RenderOptions struct {
+	// File and sample format of the rendered files
+	SoundWriterOptions
+
+	// Channels maps output channels to module outlets, channel i of the
+	// sound file gets outlet Channels[i], a negative index gives a silent
+	// channel. If empty every outlet is rendered to its own channel
+	Channels []int `json:"channels"`
+
+	// Render each channel to its own mono file (stems) instead of a single
+	// interleaved file, file names get the channel number as suffix
+	Stems bool `json:"stems"`
+
+	// Start and end time in seconds of the rendered range. The graph always
+	// runs from time 0, so score events and module state before the range
+	// are the same as in a full render. If end is 0 the range ends at the
+	// number of seconds given to the render function
+	Start float64 `json:"start"`
+	End   float64 `json:"end"`
+
+	// How the graph advances up to start: "run" performs DSP and discards
+	// the output, "fastforward" only plays scores and advances modules that
+	// implement FastForwarder, which is faster but leaves the state of other
+	// modules behind. If empty run is used
+	Seek string `json:"seek"`
+}
+
+// frameRange returns the first and end frame of the rendered range
+func (options *RenderOptions) frameRange(numSeconds float64, sr float64) (int64, int64, error) {
+	end := numSeconds
+	if options.End > 0.0 {
+		end = options.End
+	}
+
+	if options.Start < 0.0 {
+		return 0, 0, fmt.Errorf("Render start %v is negative", options.Start)
+	}
+
+	if options.Start > 0.0 && end <= options.Start {
+		return 0, 0, fmt.Errorf("Render end %v is not after start %v", end, options.Start)
+	}
+
+	switch options.Seek {
+	case "", "run", "fastforward":
+	default:
+		return 0, 0, fmt.Errorf("Unknown seek mode %v", options.Seek)
+	}
+
+	return int64(options.Start*sr + 0.5), int64(end*sr + 0.5), nil
+}
+
+// channelMap returns the outlet index for every output channel
+func (options *RenderOptions) channelMap(numOutlets int) ([]int, error) {
+	if len(options.Channels) == 0 {
+		channels := make([]int, numOutlets)
+		for i := range channels {
+			channels[i] = i
+		}
+
+		return channels, nil
+	}
+
+	for _, outlet := range options.Channels {
+		if outlet >= numOutlets {
+			return nil, fmt.Errorf("Channel map refers to outlet %d, module has %d outlets", outlet, numOutlets)
+		}
+	}
+
+	return options.Channels, nil
+}
+
+// StemFilePath returns the file path for the stem of channel (zero based),
+// the channel number is inserted before the file extension
+func StemFilePath(filePath string, channel int) string {
+	ext := filepath.Ext(filePath)
+
+	return fmt.Sprintf("%s_%d%s", strings.TrimSuffix(filePath, ext), channel+1, ext)
+}
+
+/*
+	Render
+*/
+
+// RenderSource creates a fresh module for every pass of a render, the
+// renderer cleans up the module after each pass
+type RenderSource func() (Module, error)
+
+// renderTarget is a sound writer and the outlets it writes
+type renderTarget struct {
+	writer   *SoundWriter
+	channels []int
+	samples  []float64
+}
+
+// targetOpener opens the sound writer for target index with numChannels
+// interleaved channels
+type targetOpener func(index int, numChannels int32, samplerate int32) (*SoundWriter, error)
+
+// RenderModule renders numSeconds of module output to a sound file. The outlets
+// are interleaved in a single file with any number of channels, or rendered to
+// a mono file per channel, depending on options. Options can be nil
+func RenderModule(module Module, filePath string, numSeconds float64, options *RenderOptions) error {
+	_, err := RenderModuleWithStats(module, filePath, numSeconds, options)
+	return err
+}
+
+// RenderModuleWithStats renders like RenderModule and returns the statistics
+// of every rendered file, one per stem or a single one for an interleaved file
+func RenderModuleWithStats(module Module, filePath string, numSeconds float64, options *RenderOptions) ([]*SoundStats, error) {
+	if options == nil {
+		options = &RenderOptions{}
+	}
+
+	normalize, err := options.resolveNormalization(true, "tempfile")
+	if err != nil {
+		return nil, err
+	}
+
+	return renderModule(module, numSeconds, options, fileOpener(filePath, options, func(int) *normalization {
+		return normalize
+	}))
+}
+
+// RenderModuleToWriter renders numSeconds of module output as a wav or aiff
+// stream to writer, without temporary files. Normalized renders are kept in
+// memory until the end, options can be nil
+func RenderModuleToWriter(module Module, writer io.Writer, numSeconds float64, options *RenderOptions) (*SoundStats, error) {
+	if options == nil {
+		options = &RenderOptions{}
+	}
+
+	normalize, err := options.resolveNormalization(true, "memory")
+	if err != nil {
+		return nil, err
+	}
+
+	stats, err := renderModule(module, numSeconds, options, streamOpener(writer, options, normalize))
+	if err != nil {
+		return nil, err
+	}
+
+	return stats[0], nil
+}
+
+// RenderSourceWithStats renders module output from source to a sound file
+// like RenderModuleWithStats, the twopass normalize strategy is supported
+func RenderSourceWithStats(source RenderSource, filePath string, numSeconds float64, options *RenderOptions) ([]*SoundStats, error) {
+	if options == nil {
+		options = &RenderOptions{}
+	}
+
+	normalize, err := options.resolveNormalization(true, "tempfile")
+	if err != nil {
+		return nil, err
+	}
+
+	if normalize.strategy != "twopass" || !normalize.buffered() {
+		return renderSource(source, numSeconds, options, fileOpener(filePath, options, func(int) *normalization {
+			return normalize
+		}))
+	}
+
+	gains, err := measureSource(source, numSeconds, options, normalize)
+	if err != nil {
+		return nil, err
+	}
+
+	return renderSource(source, numSeconds, options, fileOpener(filePath, options, func(index int) *normalization {
+		return fixedGain(gains[index])
+	}))
+}
+
+// RenderSourceToWriter renders module output from source as a wav or aiff
+// stream to writer like RenderModuleToWriter. With the twopass normalize
+// strategy the first pass only measures, so nothing is kept in memory
+func RenderSourceToWriter(source RenderSource, writer io.Writer, numSeconds float64, options *RenderOptions) (*SoundStats, error) {
+	if options == nil {
+		options = &RenderOptions{}
+	}
+
+	normalize, err := options.resolveNormalization(true, "memory")
+	if err != nil {
+		return nil, err
+	}
+
+	if normalize.strategy == "twopass" && normalize.buffered() {
+		gains, err := measureSource(source, numSeconds, options, normalize)
+		if err != nil {
+			return nil, err
+		}
+
+		normalize = fixedGain(gains[0])
+	}
+
+	stats, err := renderSource(source, numSeconds, options, streamOpener(writer, options, normalize))
+	if err != nil {
+		return nil, err
+	}
+
+	return stats[0], nil
+}
+
+// fileOpener opens sound file writers for the file path or its stems
+func fileOpener(filePath string, options *RenderOptions, normalize func(index int) *normalization) targetOpener {
+	return func(index int, numChannels int32, samplerate int32) (*SoundWriter, error) {
+		path := filePath
+		if options.Stems {
+			path = StemFilePath(filePath, index)
+		}
+
+		return openSoundFileWriter(path, numChannels, samplerate, normalize(index), &options.SoundWriterOptions)
+	}
+}
+
+// streamOpener opens a stream writer, streams can not have stems
+func streamOpener(writer io.Writer, options *RenderOptions, normalization *normalization) targetOpener {
+	return func(index int, numChannels int32, samplerate int32) (*SoundWriter, error) {
+		if options.Stems {
+			return nil, errors.New("Stems can not be rendered to a single stream")
+		}
+
+		return newSoundStreamWriter(writer, numChannels, samplerate, normalization, &options.SoundWriterOptions)
+	}
+}
+
+// measureSource renders a first pass from source that only measures the
+// output, returns the normalization gain of every target
+func measureSource(source RenderSource, numSeconds float64, options *RenderOptions, normalization *normalization) ([]float64, error) {
+	stats, err := renderSource(source, numSeconds, options, func(index int, numChannels int32, samplerate int32) (*SoundWriter, error) {
+		w := newSoundWriter(numChannels, samplerate, fixedGain(1.0), &soundFormat{float: true, bits: 64})
+		w.create = func() (soundFileWriter, error) {
+			return discardWriter{}, nil
+		}
+
+		return w, nil
+	})
+
+	if err != nil {
+		return nil, err
+	}
+
+	gains := make([]float64, len(stats))
+	for i, s := range stats {
+		gains[i] = normalization.gainFor(s)
+	}
+
+	return gains, nil
+}
+
+// discardWriter is the output of a measuring pass
+type discardWriter struct{}
+
+// WriteSamples discards samples
+func (discardWriter) WriteSamples(samples []float64) error {
+	return nil
+}
+
+// Close does nothing
+func (discardWriter) Close() error {
+	return nil
+}
+
+// renderSource renders a module created by source and cleans it up
+func renderSource(source RenderSource, numSeconds float64, options *RenderOptions, open targetOpener) ([]*SoundStats, error) {
+	module, err := source()
+	if err != nil {
+		return nil, err
+	}
+
+	defer module.Cleanup()
+
+	return renderModule(module, numSeconds, options, open)
+}
+
+// renderModule renders numSeconds of module output to the targets opened
+// with open, returns the statistics of every target
+func renderModule(module Module, numSeconds float64, options *RenderOptions, open targetOpener) ([]*SoundStats, error) {
+	outlets := module.GetOutlets()
+	sr := module.GetSampleRate()
+	buflen := module.GetBufferLength()
+
+	// Sanity check on outlets
+	if len(outlets) < 1 {
+		return nil, errors.New("Module must have at least one output")
+	}
+
+	channels, err := options.channelMap(len(outlets))
+	if err != nil {
+		return nil, err
+	}
+
+	startFrame, endFrame, err := options.frameRange(numSeconds, sr)
+	if err != nil {
+		return nil, err
+	}
+
+	// Open sound writers
+	var targets []*renderTarget
+
+	closeTargets := func() {
+		for _, target := range targets {
+			target.writer.Close()
+		}
+	}
+
+	if options.Stems {
+		for c, outlet := range channels {
+			writer, err := open(c, 1, int32(sr))
+			if err != nil {
+				closeTargets()
+				return nil, err
+			}
+
+			targets = append(targets, &renderTarget{
+				writer:   writer,
+				channels: []int{outlet},
+				samples:  make([]float64, buflen),
+			})
+		}
+	} else {
+		writer, err := open(0, int32(len(channels)), int32(sr))
+		if err != nil {
+			return nil, err
+		}
+
+		targets = append(targets, &renderTarget{
+			writer:   writer,
+			channels: channels,
+			samples:  make([]float64, int32(len(channels))*buflen),
+		})
+	}
+
+	// Seek to the start of the range, fast forward if the module supports it
+	fastForwarder, canFastForward := module.(FastForwarder)
+	fastForward := options.Seek == "fastforward" && canFastForward
+
+	for timestamp := int64(0); timestamp < endFrame; timestamp += int64(buflen) {
+		if timestamp+int64(buflen) <= startFrame {
+			if fastForward {
+				fastForwarder.FastForward(timestamp)
+			} else {
+				module.PrepareDSP()
+				module.RequestDSP(timestamp)
+			}
+
+			continue
+		}
+
+		module.PrepareDSP()
+		module.RequestDSP(timestamp)
+
+		// Part of the buffer inside the range
+		from := int64(0)
+		if startFrame > timestamp {
+			from = startFrame - timestamp
+		}
+
+		to := int64(buflen)
+		if endFrame-timestamp < to {
+			to = endFrame - timestamp
+		}
+
+		for _, target := range targets {
+			numChannels := int64(len(target.channels))
+
+			// Interleave channels
+			for c, outlet := range target.channels {
+				for j := from; j < to; j++ {
+					v := 0.0
+					if outlet >= 0 {
+						v = outlets[outlet].Buffer[j]
+					}
+
+					target.samples[(j-from)*numChannels+int64(c)] = v
+				}
+			}
+
+			// Write samples
+			err = target.writer.WriteSamples(target.samples[:(to-from)*numChannels])
+			if err != nil {
+				closeTargets()
+				return nil, err
+			}
+		}
+	}
+
+	// Close writers, this normalizes and exports the final files
+	stats := make([]*SoundStats, 0, len(targets))
+
+	for _, target := range targets {
+		closeErr := target.writer.Close()
+		if closeErr != nil && err == nil {
+			err = closeErr
+		}
+
+		stats = append(stats, target.writer.Stats())
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
@@ -0,0 +1,217 @@
+package farsounds
+
+import "sync/atomic"
+
+/*
+	Patch schedules
+*/
+
+// ScheduleMode selects how a patch performs DSP on its internal modules
+type ScheduleMode int
+
+const (
+	// ScheduleCompiled flattens the module graph into an ordered execution
+	// plan whenever connections change and runs that plan without recursion
+	ScheduleCompiled ScheduleMode = iota
+
+	// SchedulePull recursively pulls DSP from the outlet modules, walking
+	// the connections every buffer
+	SchedulePull
+
+	// ScheduleParallel runs the compiled execution plan on a worker pool,
+	// modules that do not depend on each other are processed at the same
+	// time. The output is bit-identical to the compiled schedule, but modules
+	// must not share state with other modules during DSP
+	ScheduleParallel
+)
+
+// graphModule is a module that knows the connection generation of its patch
+type graphModule interface {
+	setGeneration(generation *uint64)
+	bumpGeneration()
+}
+
+// setGeneration sets the connection generation of the patch the module is in
+func (baseModule *BaseModule) setGeneration(generation *uint64) {
+	baseModule.generation = generation
+}
+
+// bumpGeneration increases the connection generation of the patch the module
+// is in, so its compiled schedule is rebuilt
+func (baseModule *BaseModule) bumpGeneration() {
+	if baseModule.generation != nil {
+		atomic.AddUint64(baseModule.generation, 1)
+	}
+}
+
+// graphChanged invalidates the compiled schedule of the patch module is in,
+// connections only invalidate the schedules of their own patches
+func graphChanged(module Module) {
+	if m, ok := module.(graphModule); ok {
+		m.bumpGeneration()
+	}
+}
+
+// scheduleInlet holds an inlet of a scheduled module and the buffers of
+// the connections to it
+type scheduleInlet struct {
+	inlet   *Inlet
+	sources []*Buffer
+}
+
+// scheduleFeedback holds a feedback connection and the outlet it copies
+// at the end of each buffer
+type scheduleFeedback struct {
+	conn   *Connection
+	source *Outlet
+}
+
+// scheduleStep is a single module in the execution plan
+type scheduleStep struct {
+	module Module
+	inlets []scheduleInlet
+}
+
+// schedule is the compiled execution plan for a patch
+type schedule struct {
+	// Connection generation the schedule was compiled for
+	generation uint64
+
+	// Modules in the order they must be processed
+	steps []scheduleStep
+
+	// Feedback connections to update after all modules are processed
+	feedback []scheduleFeedback
+
+	// Step indices divided in levels for the parallel schedule
+	levels [][]int
+}
+
+// compileSchedule flattens the module graph of the patch into an ordered slice.
+// The order is the same order in which the pull model would call DSP on the
+// modules, so an undeclared cyclic connection reads the same outlet buffer
+func compileSchedule(patch *Patch) *schedule {
+	s := &schedule{
+		generation: atomic.LoadUint64(&patch.generation),
+		steps:      make([]scheduleStep, 0, patch.Modules.Len()),
+	}
+
+	visited := make(map[Module]bool)
+
+	var visit func(module Module)
+
+	visit = func(module Module) {
+		if visited[module] {
+			return
+		}
+
+		visited[module] = true
+
+		inlets := module.GetInlets()
+		step := scheduleStep{
+			module: module,
+			inlets: make([]scheduleInlet, len(inlets)),
+		}
+
+		for i, inlet := range inlets {
+			step.inlets[i].inlet = inlet
+			step.inlets[i].sources = make([]*Buffer, 0, inlet.Connections.Len())
+
+			for e := inlet.Connections.Front(); e != nil; e = e.Next() {
+				conn := e.Value.(*Connection)
+
+				// Feedback connections read the previous output
+				if conn.Feedback {
+					step.inlets[i].sources = append(step.inlets[i].sources, &conn.Buffer)
+					continue
+				}
+
+				visit(conn.To)
+
+				step.inlets[i].sources = append(step.inlets[i].sources, &conn.To.GetOutlets()[conn.Index].Buffer)
+			}
+		}
+
+		s.steps = append(s.steps, step)
+	}
+
+	for _, outletModule := range patch.OutletModules {
+		visit(outletModule)
+	}
+
+	// Sources of feedback connections are processed even if they are only
+	// reachable through the feedback connection
+	patch.forEachFeedback(func(conn *Connection, source *Outlet) {
+		visit(conn.To)
+
+		s.feedback = append(s.feedback, scheduleFeedback{conn: conn, source: source})
+	})
+
+	s.computeLevels()
+
+	return s
+}
+
+// isValid checks if the schedule was compiled for the current connections
+// of patch
+func (s *schedule) isValid(patch *Patch) bool {
+	return s.generation == atomic.LoadUint64(&patch.generation)
+}
+
+// run performs DSP on all modules in the execution plan
+func (s *schedule) run(timestamp int64) {
+	for i := range s.steps {
+		s.runStep(i, timestamp)
+	}
+
+	s.storeFeedback()
+}
+
+// runParallel performs DSP on all modules in the execution plan, level by
+// level, using the shared worker pool
+func (s *schedule) runParallel(timestamp int64) {
+	pool := getWorkerPool()
+
+	for _, level := range s.levels {
+		if len(level) == 1 {
+			s.runStep(level[0], timestamp)
+			continue
+		}
+
+		pool.run(len(level), func(i int) {
+			s.runStep(level[i], timestamp)
+		})
+	}
+
+	s.storeFeedback()
+}
+
+// runStep sums the inlets of a single module and performs DSP on it
+func (s *schedule) runStep(index int, timestamp int64) {
+	step := &s.steps[index]
+
+	for _, inlet := range step.inlets {
+		inBuffer := inlet.inlet.Buffer
+
+		// Zero out inlet buffer
+		for i := range inBuffer {
+			inBuffer[i] = 0.0
+		}
+
+		// Add connected outputs to input buffer
+		for _, source := range inlet.sources {
+			for i, v := range *source {
+				inBuffer[i] += v
+			}
+		}
+	}
+
+	step.module.DSP(timestamp)
+}
+
+// storeFeedback copies outputs to feedback connections
+func (s *schedule) storeFeedback() {
+	for _, feedback := range s.feedback {
+		copy(feedback.conn.Buffer, feedback.source.Buffer)
+	}
+}
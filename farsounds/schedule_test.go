@@ -0,0 +1,130 @@
+package farsounds_test
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/almerlucke/go-farsounds/farsounds"
+	"github.com/almerlucke/go-farsounds/farsounds/components"
+)
+
+// newRandomPatch generates a patch with numModules randomly connected modules.
+// The same seed always generates the same patch, so two patches can be compared
+// sample by sample. A small amount of cyclic connections is added on purpose
+func newRandomPatch(numModules int, seed int64, buflen int32, sr float64) *farsounds.Patch {
+	rnd := rand.New(rand.NewSource(seed))
+	patch := farsounds.NewPatch(0, 2, buflen, sr)
+	modules := make([]farsounds.Module, numModules)
+
+	for i := 0; i < numModules; i++ {
+		var module farsounds.Module
+
+		switch rnd.Intn(4) {
+		case 0:
+			module = components.NewOscModule(farsounds.SineTable, 0.0, rnd.Float64()*2000.0+20.0, 1.0, buflen, sr)
+		case 1:
+			module = components.NewSquareModule(0.0, rnd.Float64()*200.0+20.0, 0.5, buflen, sr)
+		case 2:
+			module = components.NewDelayModule(0.1, rnd.Float64()*0.1, buflen, sr)
+		default:
+			module = components.NewAllpassModule(0.1, rnd.Float64()*0.1, 0.5, buflen, sr)
+		}
+
+		module.SetIdentifier(fmt.Sprintf("module%d", i+1))
+		patch.AddModule(module)
+		modules[i] = module
+
+		// Connect earlier modules to the first inlet, the other inlets of these
+		// modules can make the output explode
+		if i > 0 {
+			numConnections := rnd.Intn(3) + 1
+			for j := 0; j < numConnections; j++ {
+				modules[rnd.Intn(i)].Connect(0, module, 0)
+			}
+		}
+	}
+
+	// Add a few cyclic connections
+	for i := 0; i < numModules/50; i++ {
+		from := rnd.Intn(numModules)
+		to := rnd.Intn(from + 1)
+		modules[from].Connect(0, modules[to], 0)
+	}
+
+	// Connect the last modules to the patch outlets
+	for i := numModules - 1; i >= 0 && i >= numModules-8; i-- {
+		modules[i].Connect(0, patch.OutletModules[i%2], 0)
+	}
+
+	return patch
+}
+
+// compareSchedules renders numCycles buffers of the same generated patch with
+// the pull model and with mode and checks that they are bit-identical
+func compareSchedules(t *testing.T, mode farsounds.ScheduleMode, numModules int, numCycles int, buflen int32, sr float64) {
+	pullPatch := newRandomPatch(numModules, 1, buflen, sr)
+	pullPatch.Schedule = farsounds.SchedulePull
+	defer pullPatch.Cleanup()
+
+	patch := newRandomPatch(numModules, 1, buflen, sr)
+	patch.Schedule = mode
+	defer patch.Cleanup()
+
+	timestamp := int64(0)
+
+	for cycle := 0; cycle < numCycles; cycle++ {
+		pullPatch.PrepareDSP()
+		pullPatch.RequestDSP(timestamp)
+		patch.PrepareDSP()
+		patch.RequestDSP(timestamp)
+
+		for c, outlet := range pullPatch.Outlets {
+			for i, v := range outlet.Buffer {
+				if math.Float64bits(v) != math.Float64bits(patch.Outlets[c].Buffer[i]) {
+					t.Fatalf("Schedules differ at cycle %d, channel %d, sample %d", cycle, c, i)
+				}
+			}
+		}
+
+		timestamp += int64(buflen)
+	}
+}
+
+func TestCompiledMatchesPull(t *testing.T) {
+	for _, numModules := range []int{10, 100, 300} {
+		compareSchedules(t, farsounds.ScheduleCompiled, numModules, 50, 64, 44100.0)
+	}
+}
+
+func BenchmarkSchedule(b *testing.B) {
+	modes := []struct {
+		name string
+		mode farsounds.ScheduleMode
+	}{
+		{"pull", farsounds.SchedulePull},
+		{"compiled", farsounds.ScheduleCompiled},
+		{"parallel", farsounds.ScheduleParallel},
+	}
+
+	for _, numModules := range []int{10, 100, 300, 1000} {
+		for _, m := range modes {
+			b.Run(fmt.Sprintf("%s/%d", m.name, numModules), func(b *testing.B) {
+				patch := newRandomPatch(numModules, 1, 512, 44100.0)
+				patch.Schedule = m.mode
+				defer patch.Cleanup()
+
+				timestamp := int64(0)
+
+				b.ResetTimer()
+
+				for i := 0; i < b.N; i++ {
+					patch.PrepareDSP()
+					patch.RequestDSP(timestamp)
+					timestamp += 512
+				}
+			})
+		}
+	}
+}
@@ -2,6 +2,14 @@ package farsounds
 
 import (
 	"container/list"
+	"errors"
+	"fmt"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 
 	"github.com/mitchellh/mapstructure"
 )
@@ -11,6 +19,10 @@ type scoreEventDesc struct {
 	// Time in seconds
 	On float64
 
+	// Time in bars and beats for scores with a tempo, both zero based
+	Bar  *float64
+	Beat *float64
+
 	// Action
 	Action string
 
@@ -18,6 +30,34 @@ type scoreEventDesc struct {
 	Payload interface{}
 }
 
+// scoreTempoDesc is a tempo point in a score script
+type scoreTempoDesc struct {
+	// Position in bars and beats, both zero based
+	Bar  float64
+	Beat float64
+
+	// Tempo in beats per minute
+	BPM float64
+
+	// Ramp from the previous tempo instead of a step
+	Ramp bool
+}
+
+// scoreDesc is a score script with a tempo
+type scoreDesc struct {
+	// Initial tempo in beats per minute
+	BPM float64
+
+	// Number of beats in a bar
+	BeatsPerBar float64
+
+	// Tempo changes
+	Tempo []*scoreTempoDesc
+
+	// Events
+	Events []*scoreEventDesc
+}
+
 /*
 	Score actions
 */
@@ -30,12 +70,55 @@ type ScoreAction interface {
 // ScoreResetAction triggers reset on player
 type ScoreResetAction struct{}
 
-// Action reset
+// Action reset, the score restarts at the sample of the reset event
 func (action *ScoreResetAction) Action(scorePlayer *ScorePlayer, module Module, time *float64) {
 	scorePlayer.Reset()
+	scorePlayer.moveTo(0.0, module.GetSampleRate())
 	*time = 0.0
 }
 
+/*
+	Tempo action
+*/
+
+// ScoreTempoAction changes the tempo of the player from the beat of the event,
+// the events that follow move with the new tempo
+type ScoreTempoAction struct {
+	// New tempo in beats per minute
+	BPM float64
+
+	// Number of beats to ramp to the new tempo, 0 is a step
+	Ramp float64
+}
+
+// NewScoreTempoAction new tempo action from payload with bpm and ramp
+func NewScoreTempoAction(payload interface{}) *ScoreTempoAction {
+	action := ScoreTempoAction{BPM: defaultBPM}
+
+	if values, ok := payload.(map[string]interface{}); ok {
+		if bpm, ok := values["bpm"].(float64); ok {
+			action.BPM = bpm
+		}
+
+		if ramp, ok := values["ramp"].(float64); ok {
+			action.Ramp = ramp
+		}
+	} else if bpm, ok := payload.(float64); ok {
+		action.BPM = bpm
+	}
+
+	return &action
+}
+
+// Action tempo, scores without a tempo are timed in seconds and ignore it
+func (action *ScoreTempoAction) Action(player *ScorePlayer, module Module, time *float64) {
+	if player.Tempo == nil || action.BPM <= 0.0 {
+		return
+	}
+
+	player.Tempo.SetTempo(player.Tempo.Beat(*time), action.BPM, action.Ramp)
+}
+
 /*
 	Send action
 */
@@ -52,7 +135,8 @@ type ScoreSendAction struct {
 	Deliveries []*ScoreDelivery
 }
 
-// NewScoreSendAction new send action
+// NewScoreSendAction new send action, the payload maps addresses to messages.
+// Addresses can be patterns, see Patch.SendMessage
 func NewScoreSendAction(payload interface{}) *ScoreSendAction {
 	action := ScoreSendAction{}
 
@@ -71,16 +155,30 @@ func NewScoreSendAction(payload interface{}) *ScoreSendAction {
 			deliveryIndex++
 		}
 
+		// Deliver in address order, so overlapping patterns are applied in
+		// the same order every time
+		sort.Slice(deliveries, func(i, j int) bool {
+			return deliveries[i].Address < deliveries[j].Address
+		})
+
 		action.Deliveries = deliveries
 	}
 
 	return &action
 }
 
-// Action send
+// Action send, messages are timed at the sample offset of the event. Muted
+// players send nothing
 func (action *ScoreSendAction) Action(player *ScorePlayer, module Module, time *float64) {
+	if player.Muted {
+		return
+	}
+
 	for _, delivery := range action.Deliveries {
-		module.SendMessage(NewAddress(delivery.Address), delivery.Message)
+		module.SendMessage(NewAddress(delivery.Address), &TimedMessage{
+			Message: delivery.Message,
+			Offset:  player.Offset,
+		})
 	}
 }
 
@@ -93,6 +191,9 @@ type ScoreEvent struct {
 	// Time in seconds when to trigger this entry
 	On float64
 
+	// Time in beats, used instead of On when the score has a tempo
+	Beat float64
+
 	// Action
 	Action ScoreAction
 }
@@ -100,53 +201,299 @@ type ScoreEvent struct {
 // Score event list
 type Score struct {
 	Events *list.List
+
+	// Tempo map for scores timed in beats, nil for scores timed in seconds
+	Tempo *TempoMap
 }
 
 // ScorePlayer for score
 type ScorePlayer struct {
+	// Identifier of the player, players are addressed by identifier in their
+	// patch, see ScorePlayer.Message
+	Identifier string
+
+	// Score time in samples at the start of the next block, the fraction
+	// holds the part of a sample that rates other than 1 leave
 	Timestamp int64
+	fraction  float64
 	Score     *Score
 	LastEvent *list.Element
+
+	// Transport, a paused player holds its events, a muted player plays all
+	// events but sends no messages. Rate is the playback speed of the score
+	Paused bool
+	Muted  bool
+	Rate   float64
+
+	// Loop region in seconds, the player loops while LoopEnd is after
+	// LoopStart
+	LoopStart float64
+	LoopEnd   float64
+
+	// Sample offset within the block of the event being played
+	Offset int32
+
+	// Tempo map of the player, a copy of the score tempo map that can be
+	// changed at runtime by tempo actions
+	Tempo *TempoMap
+
+	// Number of jumps made by counted jump actions
+	jumpCounts map[*ScoreJumpAction]int
+
+	// Running pattern streams
+	streams []*scoreStream
+
+	// Set by stop actions, a stopped player plays nothing until it is reset
+	stopped bool
+
+	// Transport messages waiting for the start of the next block
+	pending []map[string]interface{}
+
+	// Scores are loaded on a separate goroutine and played from the start of
+	// the next block once they are loaded, the last requested load wins
+	loadRequests uint64
+	loadApplied  uint64
+	loaded       atomic.Value
+	loadMutex    sync.Mutex
+	err          error
+}
+
+// scoreStream is a pattern stream started by a player
+type scoreStream struct {
+	stream *PatternStream
+
+	// Start of the stream in beats for players with a tempo, in seconds
+	// otherwise
+	start float64
+
+	// Next event of the stream, timed in the player
+	next *ScoreEvent
 }
 
 // SetScore for player
 func (player *ScorePlayer) SetScore(score *Score) {
 	player.Score = score
-	player.LastEvent = score.Events.Front()
+	player.Reset()
+}
+
+// eventTime returns the time of event in seconds
+func (player *ScorePlayer) eventTime(event *ScoreEvent) float64 {
+	if player.Tempo != nil {
+		return player.Tempo.Seconds(event.Beat)
+	}
+
+	return event.On
+}
+
+// startStream plays the events of a pattern stream from time in seconds
+func (player *ScorePlayer) startStream(stream *PatternStream, time float64) {
+	s := &scoreStream{
+		stream: stream,
+		start:  time,
+	}
+
+	if player.Tempo != nil {
+		s.start = player.Tempo.Beat(time)
+	}
+
+	player.streams = append(player.streams, s)
+	player.advanceStream(s)
+}
+
+// advanceStream gets the next event of a stream, streams that end are removed
+func (player *ScorePlayer) advanceStream(s *scoreStream) {
+	s.next = s.stream.Next()
+
+	if s.next == nil {
+		for i, other := range player.streams {
+			if other == s {
+				player.streams = append(player.streams[:i], player.streams[i+1:]...)
+				break
+			}
+		}
+
+		return
+	}
+
+	if player.Tempo != nil {
+		s.next.Beat = s.start + s.next.On
+	} else {
+		s.next.On += s.start
+	}
+}
+
+// moveStreams moves the running streams from time to time in seconds, so they
+// play on without a break when the player jumps
+func (player *ScorePlayer) moveStreams(from float64, to float64) {
+	for _, s := range player.streams {
+		if player.Tempo != nil {
+			delta := player.Tempo.Beat(to) - player.Tempo.Beat(from)
+			s.start += delta
+			s.next.Beat += delta
+		} else {
+			s.start += to - from
+			s.next.On += to - from
+		}
+	}
+}
+
+// nextEvent returns the next event to play and its stream, nil for events of
+// the score. The score goes first at equal times
+func (player *ScorePlayer) nextEvent() (*ScoreEvent, *scoreStream) {
+	var event *ScoreEvent
+	var stream *scoreStream
+
+	time := math.Inf(1)
+
+	if player.LastEvent != nil {
+		event = player.LastEvent.Value.(*ScoreEvent)
+		time = player.eventTime(event)
+	}
+
+	for _, s := range player.streams {
+		if t := player.eventTime(s.next); t < time {
+			event = s.next
+			stream = s
+			time = t
+		}
+	}
+
+	return event, stream
 }
 
-// Play events, time is in seconds
+// Play the events that fall in the next block of module, every event is
+// played with its sample offset within the block. Events of pattern streams
+// are played next to the events of the score. Transport messages are applied
+// first, paused players do nothing else
 func (player *ScorePlayer) Play(module Module) {
-	time := float64(player.Timestamp) / module.GetSampleRate()
+	player.applyTransport(module)
+
+	if player.Paused {
+		return
+	}
+
+	sr := module.GetSampleRate()
+	buflen := int64(module.GetBufferLength())
+
+	// Events can pause the player, the events that follow are held
+	for !player.Paused {
+		event, stream := player.nextEvent()
+
+		// Wrap around at the end of the loop region, unless a stop action
+		// ended the score
+		if !player.stopped && player.loops(sr) && (event == nil || player.eventTime(event) >= player.LoopEnd) {
+			offset := player.blockOffset(player.LoopEnd, sr)
+			if offset < buflen {
+				if offset < 0 {
+					offset = 0
+				}
+
+				player.Offset = int32(offset)
+				player.moveStreams(player.LoopEnd, player.LoopStart)
+				player.seekEvent(player.LoopStart)
+				player.moveTo(player.LoopStart, sr)
+
+				continue
+			}
+		}
+
+		if event == nil {
+			break
+		}
+
+		time := player.eventTime(event)
 
-	player.Timestamp += int64(module.GetBufferLength())
+		offset := player.blockOffset(time, sr)
+		if offset >= buflen {
+			break
+		}
+
+		if offset < 0 {
+			offset = 0
+		}
 
-	for player.LastEvent != nil && player.LastEvent.Value.(*ScoreEvent).On <= time {
-		event := player.LastEvent.Value.(*ScoreEvent)
+		player.Offset = int32(offset)
 
-		player.LastEvent = player.LastEvent.Next()
+		if stream != nil {
+			player.advanceStream(stream)
+		} else {
+			player.LastEvent = player.LastEvent.Next()
+		}
 
-		event.Action.Action(player, module, &time)
+		// Rests of pattern streams have no action
+		if event.Action != nil {
+			event.Action.Action(player, module, &time)
+		}
 	}
+
+	player.Offset = 0
+	player.advance(buflen)
 }
 
-// Reset score player
+// Reset score player, tempo changes made at runtime and jump counts are
+// undone and pattern streams are stopped. Transport settings are kept
 func (player *ScorePlayer) Reset() {
 	player.Timestamp = 0
+	player.fraction = 0.0
 	player.LastEvent = player.Score.Events.Front()
+	player.Tempo = nil
+	player.jumpCounts = make(map[*ScoreJumpAction]int)
+	player.streams = nil
+	player.stopped = false
+
+	if player.Score.Tempo != nil {
+		player.Tempo = player.Score.Tempo.Copy()
+	}
 }
 
 // NewScorePlayer create new score player
 func NewScorePlayer(score *Score) *ScorePlayer {
-	return &ScorePlayer{
-		Score:     score,
-		LastEvent: score.Events.Front(),
-	}
+	player := &ScorePlayer{Rate: 1.0}
+	player.SetScore(score)
+
+	return player
 }
 
-// LoadScore load score
+// LoadScore load score. A score script is a list of events timed in seconds,
+// or an object with a tempo (bpm, beatsPerBar and a tempo map) and events
+// timed in bars and beats. MIDI files (.mid, .midi) are loaded with the
+// default MIDI routes. Include events insert the events of another score file,
+// relative to the time of the include event. Pattern events start a pattern
+// stream, see NewPatternStream
 func LoadScore(filePath string) (*Score, error) {
+	score, err := loadScore(filePath, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	err = score.validateMarkers()
+	if err != nil {
+		return nil, err
+	}
+
+	return score, nil
+}
+
+// loadScore loads a score, including lists the files that include it
+func loadScore(filePath string, including []string) (*Score, error) {
+	switch strings.ToLower(filepath.Ext(filePath)) {
+	case ".mid", ".midi":
+		return LoadMIDIScore(filePath, DefaultMIDIRoutes())
+	}
+
+	for _, includingPath := range including {
+		if includingPath == filePath {
+			return nil, fmt.Errorf("Score %v includes itself", filePath)
+		}
+	}
+
+	including = append(including, filePath)
+
 	_score, err := EvalScript(filePath, func(obj interface{}) (interface{}, error) {
+		if _, ok := obj.(map[string]interface{}); ok {
+			return loadTempoScore(obj, including)
+		}
+
 		var rawEvents []*scoreEventDesc
 
 		err := mapstructure.Decode(obj, &rawEvents)
@@ -154,25 +501,43 @@ func LoadScore(filePath string) (*Score, error) {
 			return nil, err
 		}
 
-		score := Score{}
-		events := list.New()
+		var events []*ScoreEvent
 
 		// Loop through raw events
-		for _, rawEvent := range rawEvents {
-			event := ScoreEvent{On: rawEvent.On}
-
-			switch rawEvent.Action {
-			case "send":
-				event.Action = NewScoreSendAction(rawEvent.Payload)
-			case "reset":
-				event.Action = new(ScoreResetAction)
+		for i, rawEvent := range rawEvents {
+			if rawEvent.Action == "include" {
+				included, err := loadIncludedScore(rawEvent.Payload, including)
+				if err != nil {
+					return nil, err
+				}
+
+				for e := included.Events.Front(); e != nil; e = e.Next() {
+					event := *e.Value.(*ScoreEvent)
+					event.On += rawEvent.On
+					events = append(events, &event)
+				}
+
+				continue
+			}
+
+			event, err := newScoreEvent(rawEvent)
+			if err != nil {
+				return nil, fmt.Errorf("Score %v event %d: %v", filePath, i, err)
 			}
 
-			// Pushback on list
-			events.PushBack(&event)
+			events = append(events, event)
 		}
 
-		score.Events = events
+		// Events are played in order of time
+		sort.SliceStable(events, func(i, j int) bool {
+			return events[i].On < events[j].On
+		})
+
+		score := Score{Events: list.New()}
+
+		for _, event := range events {
+			score.Events.PushBack(event)
+		}
 
 		return &score, nil
 	})
@@ -183,3 +548,156 @@ func LoadScore(filePath string) (*Score, error) {
 
 	return _score.(*Score), nil
 }
+
+// loadIncludedScore loads the score of an include event, the payload is the
+// file path, relative to the including score, or an object with a file
+func loadIncludedScore(payload interface{}, including []string) (*Score, error) {
+	file, ok := payload.(string)
+	if values, isMap := payload.(map[string]interface{}); isMap {
+		file, ok = values["file"].(string)
+	}
+
+	if !ok || file == "" {
+		return nil, errors.New("Include needs a score file")
+	}
+
+	if !filepath.IsAbs(file) {
+		file = filepath.Join(filepath.Dir(including[len(including)-1]), file)
+	}
+
+	return loadScore(file, including)
+}
+
+// loadTempoScore loads a score timed in bars and beats, events timed in
+// seconds are converted to beats so they follow tempo changes at runtime.
+// Included scores are placed in beats if they have a tempo, in seconds from
+// the include event otherwise
+func loadTempoScore(obj interface{}, including []string) (*Score, error) {
+	desc := scoreDesc{}
+
+	err := mapstructure.Decode(obj, &desc)
+	if err != nil {
+		return nil, err
+	}
+
+	if desc.BPM <= 0.0 {
+		desc.BPM = defaultBPM
+	}
+
+	if desc.BeatsPerBar <= 0.0 {
+		desc.BeatsPerBar = 4.0
+	}
+
+	tempo := NewTempoMap(desc.BPM)
+
+	for _, point := range desc.Tempo {
+		if point.BPM <= 0.0 {
+			return nil, fmt.Errorf("Tempo %v at bar %v beat %v must be positive", point.BPM, point.Bar, point.Beat)
+		}
+
+		tempo.Add(TempoPoint{
+			Beat: point.Bar*desc.BeatsPerBar + point.Beat,
+			BPM:  point.BPM,
+			Ramp: point.Ramp,
+		})
+	}
+
+	var events []*ScoreEvent
+
+	for i, rawEvent := range desc.Events {
+		beat := tempo.Beat(rawEvent.On)
+
+		if rawEvent.Bar != nil || rawEvent.Beat != nil {
+			beat = 0.0
+
+			if rawEvent.Bar != nil {
+				beat += *rawEvent.Bar * desc.BeatsPerBar
+			}
+
+			if rawEvent.Beat != nil {
+				beat += *rawEvent.Beat
+			}
+		}
+
+		if rawEvent.Action == "include" {
+			included, err := loadIncludedScore(rawEvent.Payload, including)
+			if err != nil {
+				return nil, err
+			}
+
+			for e := included.Events.Front(); e != nil; e = e.Next() {
+				event := *e.Value.(*ScoreEvent)
+
+				if included.Tempo != nil {
+					event.Beat += beat
+				} else {
+					event.Beat = tempo.Beat(tempo.Seconds(beat) + event.On)
+				}
+
+				event.On = tempo.Seconds(event.Beat)
+				events = append(events, &event)
+			}
+
+			continue
+		}
+
+		event, err := newScoreEvent(rawEvent)
+		if err != nil {
+			return nil, fmt.Errorf("Score %v event %d: %v", including[len(including)-1], i, err)
+		}
+
+		event.Beat = beat
+		event.On = tempo.Seconds(beat)
+		events = append(events, event)
+	}
+
+	// Events are played in order of time
+	sort.SliceStable(events, func(i, j int) bool {
+		return events[i].Beat < events[j].Beat
+	})
+
+	score := Score{
+		Events: list.New(),
+		Tempo:  tempo,
+	}
+
+	for _, event := range events {
+		score.Events.PushBack(event)
+	}
+
+	return &score, nil
+}
+
+// newScoreEvent creates an event with the action from the event script
+func newScoreEvent(rawEvent *scoreEventDesc) (*ScoreEvent, error) {
+	var err error
+
+	event := ScoreEvent{On: rawEvent.On}
+
+	switch rawEvent.Action {
+	case "send":
+		event.Action = NewScoreSendAction(rawEvent.Payload)
+	case "reset":
+		event.Action = new(ScoreResetAction)
+	case "tempo":
+		event.Action = NewScoreTempoAction(rawEvent.Payload)
+	case "marker":
+		event.Action, err = NewScoreMarkerAction(rawEvent.Payload)
+	case "jump":
+		event.Action, err = NewScoreJumpAction(rawEvent.Payload)
+	case "loop":
+		event.Action, err = NewScoreLoopAction(rawEvent.Payload)
+	case "stop":
+		event.Action = new(ScoreStopAction)
+	case "pattern":
+		event.Action, err = NewScorePatternAction(rawEvent.Payload)
+	default:
+		err = fmt.Errorf("Unknown score action %q", rawEvent.Action)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &event, nil
+}
@@ -0,0 +1,242 @@
+package farsounds_test
+
+import (
+	"io/ioutil"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/almerlucke/go-farsounds/farsounds"
+	"github.com/almerlucke/go-farsounds/farsounds/components"
+)
+
+// renderScore renders numFrames of an envelope played by score with blocks of
+// buflen samples
+func renderScore(score *farsounds.Score, numFrames int, buflen int32, sr float64) []float64 {
+	patch := farsounds.NewPatch(0, 1, buflen, sr)
+	defer patch.Cleanup()
+
+	adsr := components.NewADSRModule(buflen, sr)
+	adsr.SetIdentifier("adsr")
+	patch.AddModule(adsr)
+	adsr.Connect(0, patch.OutletModules[0], 0)
+
+	patch.ScorePlayers.PushBack(farsounds.NewScorePlayer(score))
+
+	output := make([]float64, 0, numFrames)
+	timestamp := int64(0)
+
+	for len(output) < numFrames {
+		patch.PrepareDSP()
+		patch.RequestDSP(timestamp)
+		output = append(output, patch.Outlets[0].Buffer...)
+		timestamp += int64(buflen)
+	}
+
+	return output[:numFrames]
+}
+
+func TestTimedScoreIndependentOfBufferLength(t *testing.T) {
+	sr := 44100.0
+
+	score := farsounds.NewScore(nil)
+	score.Send(0.0, "adsr", map[string]interface{}{
+		"attackRate":   0.003,
+		"decayRate":    0.01,
+		"releaseRate":  0.02,
+		"sustainLevel": 0.5,
+	})
+
+	// Gates at times that do not fall on block boundaries
+	for i, on := range []float64{0.0013, 0.0171, 0.0302, 0.0497, 0.0711, 0.0712} {
+		score.Send(on, "adsr", map[string]interface{}{"gate": float64(1 - i%2)})
+	}
+
+	small := renderScore(score, 4096, 64, sr)
+	large := renderScore(score, 4096, 1024, sr)
+
+	nonZero := false
+
+	for i := range small {
+		if math.Float64bits(small[i]) != math.Float64bits(large[i]) {
+			t.Fatalf("Output differs at sample %d: %v != %v", i, small[i], large[i])
+		}
+
+		nonZero = nonZero || small[i] != 0.0
+	}
+
+	if !nonZero {
+		t.Fatal("Score did not open the envelope")
+	}
+}
+
+// playPatch renders numBlocks blocks of patch, it fails the test if the
+// blocks do not finish in time
+func playPatch(t *testing.T, patch *farsounds.Patch, numBlocks int) {
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		timestamp := int64(0)
+
+		for i := 0; i < numBlocks; i++ {
+			patch.PrepareDSP()
+			patch.RequestDSP(timestamp)
+			timestamp += int64(patch.GetBufferLength())
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Patch did not finish playing")
+	}
+}
+
+func TestScoreControlsOwnPlayer(t *testing.T) {
+	score := farsounds.NewScore(nil)
+	score.Send(0.0, "p", map[string]interface{}{"stop": true})
+
+	patch := farsounds.NewPatch(0, 1, 64, 44100.0)
+	defer patch.Cleanup()
+
+	player := farsounds.NewScorePlayer(score)
+	player.Identifier = "p"
+	patch.ScorePlayers.PushBack(player)
+
+	playPatch(t, patch, 4)
+
+	if !player.Paused || player.Timestamp != 0 {
+		t.Fatalf("Player is not stopped, paused %v at %d", player.Paused, player.Timestamp)
+	}
+
+	score = farsounds.NewScore(nil)
+	score.Send(0.0, "p", map[string]interface{}{"seek": 0.0})
+	player.SetScore(score)
+	player.Resume()
+
+	// The player seeks back every block, but plays on
+	playPatch(t, patch, 4)
+
+	if player.Paused || player.Timestamp != 64 {
+		t.Fatalf("Player did not seek, paused %v at %d", player.Paused, player.Timestamp)
+	}
+}
+
+func TestScoreStopInLoop(t *testing.T) {
+	sr := 44100.0
+
+	score := farsounds.NewScore(nil)
+	score.Add(0.05, &farsounds.ScoreStopAction{})
+
+	patch := farsounds.NewPatch(0, 1, 64, sr)
+	defer patch.Cleanup()
+
+	player := farsounds.NewScorePlayer(score)
+	player.SetLoop(0.0, 0.1)
+	patch.ScorePlayers.PushBack(player)
+
+	playPatch(t, patch, 200)
+
+	if float64(player.Timestamp) < 0.1*sr {
+		t.Fatalf("Player wrapped around after a stop action, at %d", player.Timestamp)
+	}
+}
+
+func TestScoreLoadError(t *testing.T) {
+	patch := farsounds.NewPatch(0, 1, 64, 44100.0)
+	defer patch.Cleanup()
+
+	player := farsounds.NewScorePlayer(farsounds.NewScore(nil))
+	player.Identifier = "p"
+	patch.ScorePlayers.PushBack(player)
+
+	patch.SendMessage(farsounds.NewAddress("p"), map[string]interface{}{"load": "does-not-exist.json"})
+
+	deadline := time.Now().Add(5 * time.Second)
+
+	for player.Err() == nil {
+		if time.Now().After(deadline) {
+			t.Fatal("Load error was not reported")
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestScoreJumpForeverToSameSample(t *testing.T) {
+	score := farsounds.NewScore(nil)
+	score.Add(0.0001, &farsounds.ScoreMarkerAction{Name: "m"})
+	score.Add(0.0001001, &farsounds.ScoreJumpAction{Marker: "m", Count: -1})
+
+	patch := farsounds.NewPatch(0, 1, 64, 44100.0)
+	defer patch.Cleanup()
+
+	player := farsounds.NewScorePlayer(score)
+	patch.ScorePlayers.PushBack(player)
+
+	playPatch(t, patch, 4)
+
+	dir, err := ioutil.TempDir("", "score")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "score.json")
+
+	err = farsounds.SaveScore(score, filePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := farsounds.LoadScore(filePath); err == nil {
+		t.Fatal("Score with a zero length loop was loaded")
+	}
+}
+
+func TestScoreLoopShorterThanRate(t *testing.T) {
+	sr := 44100.0
+
+	patch := farsounds.NewPatch(0, 1, 64, sr)
+	defer patch.Cleanup()
+
+	player := farsounds.NewScorePlayer(farsounds.NewScore(nil))
+	player.Rate = 4.0
+	player.SetLoop(0.0, 1.0/sr)
+	patch.ScorePlayers.PushBack(player)
+
+	playPatch(t, patch, 4)
+
+	player.SetLoop(0.0, 4.0/sr)
+	playPatch(t, patch, 4)
+}
+
+func TestUnconnectedEnvelopeReceivesMessages(t *testing.T) {
+	sr := 44100.0
+
+	patch := farsounds.NewPatch(0, 1, 64, sr)
+	defer patch.Cleanup()
+
+	// Not connected to an outlet, so the compiled schedule never runs it
+	adsr := components.NewADSRModule(64, sr)
+	adsr.SetIdentifier("adsr")
+	patch.AddModule(adsr)
+
+	score := farsounds.NewScore(nil)
+	for i := 0; i < 2000; i++ {
+		score.Send(float64(i)*64.0/sr, "adsr", map[string]interface{}{"gate": 1.0})
+	}
+
+	patch.ScorePlayers.PushBack(farsounds.NewScorePlayer(score))
+
+	playPatch(t, patch, 2000)
+
+	if adsr.Idle() {
+		t.Fatal("Queued messages were never applied")
+	}
+}
@@ -0,0 +1,362 @@
+package farsounds
+
+import (
+	"container/list"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"math"
+)
+
+/*
+	Score building and transformations
+*/
+
+// NewScore creates an empty score, timed in seconds or in beats if tempo is
+// not nil
+func NewScore(tempo *TempoMap) *Score {
+	return &Score{
+		Events: list.New(),
+		Tempo:  tempo,
+	}
+}
+
+// seconds returns the time of event in seconds
+func (score *Score) seconds(event *ScoreEvent) float64 {
+	if score.Tempo != nil {
+		return score.Tempo.Seconds(event.Beat)
+	}
+
+	return event.On
+}
+
+// setSeconds sets the time of event in seconds, and in beats if the score
+// has a tempo
+func (score *Score) setSeconds(event *ScoreEvent, seconds float64) {
+	event.On = seconds
+
+	if score.Tempo != nil {
+		event.Beat = score.Tempo.Beat(seconds)
+	}
+}
+
+// Insert an event in order of time, after the events at the same time. In
+// scores with a tempo the beat of the event is its time
+func (score *Score) Insert(event *ScoreEvent) {
+	key := func(event *ScoreEvent) float64 {
+		if score.Tempo != nil {
+			return event.Beat
+		}
+
+		return event.On
+	}
+
+	// Events are mostly added in order, so search from the back
+	for e := score.Events.Back(); e != nil; e = e.Prev() {
+		if key(e.Value.(*ScoreEvent)) <= key(event) {
+			score.Events.InsertAfter(event, e)
+			return
+		}
+	}
+
+	score.Events.PushFront(event)
+}
+
+// Add an action at a time in seconds and return its event
+func (score *Score) Add(on float64, action ScoreAction) *ScoreEvent {
+	event := &ScoreEvent{Action: action}
+	score.setSeconds(event, on)
+	score.Insert(event)
+
+	return event
+}
+
+// Send adds a send action with a single delivery at a time in seconds
+func (score *Score) Send(on float64, address string, message Message) *ScoreEvent {
+	return score.Add(on, &ScoreSendAction{
+		Deliveries: []*ScoreDelivery{{Address: address, Message: message}},
+	})
+}
+
+// transform returns a new score with the events of score at the times that
+// place returns, events for which place returns false are dropped. The
+// messages of send actions are copied and passed through edit if it is not nil
+func (score *Score) transform(place func(seconds float64) (float64, bool), edit func(message Message) Message) *Score {
+	var tempo *TempoMap
+	if score.Tempo != nil {
+		tempo = score.Tempo.Copy()
+	}
+
+	result := NewScore(tempo)
+	result.transformFrom(score, place, edit)
+
+	return result
+}
+
+// transformFrom inserts the transformed events of other in score
+func (score *Score) transformFrom(other *Score, place func(seconds float64) (float64, bool), edit func(message Message) Message) {
+	for e := other.Events.Front(); e != nil; e = e.Next() {
+		event := e.Value.(*ScoreEvent)
+
+		seconds, ok := place(other.seconds(event))
+		if !ok {
+			continue
+		}
+
+		action := event.Action
+		if send, ok := action.(*ScoreSendAction); ok {
+			deliveries := make([]*ScoreDelivery, len(send.Deliveries))
+
+			for i, delivery := range send.Deliveries {
+				message := copyMessage(delivery.Message)
+				if edit != nil {
+					message = edit(message)
+				}
+
+				deliveries[i] = &ScoreDelivery{Address: delivery.Address, Message: message}
+			}
+
+			action = &ScoreSendAction{Deliveries: deliveries}
+		}
+
+		copied := &ScoreEvent{Action: action}
+		score.setSeconds(copied, seconds)
+		score.Insert(copied)
+	}
+}
+
+// copyMessage returns a deep copy of the maps and lists of a message
+func copyMessage(message Message) Message {
+	switch v := message.(type) {
+	case map[string]interface{}:
+		copied := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			copied[key] = copyMessage(value)
+		}
+
+		return copied
+	case []interface{}:
+		copied := make([]interface{}, len(v))
+		for i, value := range v {
+			copied[i] = copyMessage(value)
+		}
+
+		return copied
+	}
+
+	return message
+}
+
+// Copy returns a copy of the score, messages of send actions are copied so
+// the copy can be changed independently
+func (score *Score) Copy() *Score {
+	return score.transform(func(seconds float64) (float64, bool) {
+		return seconds, true
+	}, nil)
+}
+
+// Merge returns a score with the events of score and others in order of time,
+// the merged score has the tempo of score
+func (score *Score) Merge(others ...*Score) *Score {
+	result := score.Copy()
+
+	for _, other := range others {
+		result.transformFrom(other, func(seconds float64) (float64, bool) {
+			return seconds, true
+		}, nil)
+	}
+
+	return result
+}
+
+// Shift returns a copy of the score with all events moved by seconds, events
+// that would move before zero are dropped
+func (score *Score) Shift(seconds float64) *Score {
+	return score.transform(func(on float64) (float64, bool) {
+		return on + seconds, on+seconds >= 0.0
+	}, nil)
+}
+
+// Stretch returns a copy of the score with event times and the "duration" of
+// messages multiplied by factor
+func (score *Score) Stretch(factor float64) *Score {
+	return score.transform(func(on float64) (float64, bool) {
+		return on * factor, true
+	}, func(message Message) Message {
+		if values, ok := message.(map[string]interface{}); ok {
+			if duration, ok := values["duration"].(float64); ok {
+				values["duration"] = duration * factor
+			}
+		}
+
+		return message
+	})
+}
+
+// Transpose returns a copy of the score with the "frequency" and MIDI "note"
+// of messages and their settings moved by semitones. Frequency ramps are
+// transposed as well
+func (score *Score) Transpose(semitones float64) *Score {
+	ratio := math.Pow(2.0, semitones/12.0)
+
+	var transpose func(values map[string]interface{})
+
+	transpose = func(values map[string]interface{}) {
+		switch frequency := values["frequency"].(type) {
+		case float64:
+			values["frequency"] = frequency * ratio
+		case map[string]interface{}:
+			if value, ok := frequency["value"].(float64); ok {
+				frequency["value"] = value * ratio
+			}
+		}
+
+		if note, ok := values["note"].(float64); ok {
+			values["note"] = note + semitones
+		}
+
+		if settings, ok := values["settings"].(map[string]interface{}); ok {
+			transpose(settings)
+		}
+	}
+
+	return score.transform(func(on float64) (float64, bool) {
+		return on, true
+	}, func(message Message) Message {
+		if values, ok := message.(map[string]interface{}); ok {
+			transpose(values)
+		}
+
+		return message
+	})
+}
+
+// Slice returns the events from start up to end seconds, moved so start is at
+// zero. Notes that last beyond end are not shortened
+func (score *Score) Slice(start float64, end float64) *Score {
+	return score.transform(func(on float64) (float64, bool) {
+		return on - start, on >= start && on < end
+	}, nil)
+}
+
+/*
+	Score serialization
+*/
+
+// scoreActionScript returns the action name and payload of an action in the
+// score script format
+func scoreActionScript(action ScoreAction) (string, interface{}, error) {
+	switch a := action.(type) {
+	case *ScoreResetAction:
+		return "reset", nil, nil
+	case *ScoreStopAction:
+		return "stop", nil, nil
+	case *ScoreTempoAction:
+		return "tempo", map[string]interface{}{"bpm": a.BPM, "ramp": a.Ramp}, nil
+	case *ScoreMarkerAction:
+		return "marker", a.Name, nil
+	case *ScoreJumpAction:
+		if a.Count < 0 {
+			return "jump", a.Marker, nil
+		}
+
+		return "jump", map[string]interface{}{"marker": a.Marker, "count": a.Count}, nil
+	case *ScorePatternAction:
+		payload := copyMessage(a.Payload)
+		if values, ok := payload.(map[string]interface{}); ok {
+			values["seed"] = float64(a.Seed)
+		}
+
+		return "pattern", payload, nil
+	}
+
+	return "", nil, fmt.Errorf("Score action %T can not be written to a script", action)
+}
+
+// MarshalJSON encodes the score in the script format LoadScore reads, a list
+// of events or an object with a tempo for scores timed in beats. Send actions
+// with more than one delivery to an address are split in multiple events
+func (score *Score) MarshalJSON() ([]byte, error) {
+	var events []map[string]interface{}
+
+	addEvent := func(event *ScoreEvent, action string, payload interface{}) {
+		script := map[string]interface{}{"action": action}
+
+		if score.Tempo != nil {
+			script["beat"] = event.Beat
+		} else {
+			script["on"] = event.On
+		}
+
+		if payload != nil {
+			script["payload"] = payload
+		}
+
+		events = append(events, script)
+	}
+
+	for e := score.Events.Front(); e != nil; e = e.Next() {
+		event := e.Value.(*ScoreEvent)
+
+		send, ok := event.Action.(*ScoreSendAction)
+		if !ok {
+			action, payload, err := scoreActionScript(event.Action)
+			if err != nil {
+				return nil, err
+			}
+
+			addEvent(event, action, payload)
+
+			continue
+		}
+
+		// Addresses are the keys of the payload, an address that is already
+		// in the payload starts a new event
+		var payload map[string]interface{}
+
+		for _, delivery := range send.Deliveries {
+			if _, ok := payload[delivery.Address]; ok || payload == nil {
+				payload = map[string]interface{}{}
+				addEvent(event, "send", payload)
+			}
+
+			payload[delivery.Address] = delivery.Message
+		}
+	}
+
+	if events == nil {
+		events = []map[string]interface{}{}
+	}
+
+	if score.Tempo == nil {
+		return json.Marshal(events)
+	}
+
+	points := score.Tempo.Points
+	tempo := make([]map[string]interface{}, 0, len(points))
+
+	for _, point := range points[1:] {
+		tempo = append(tempo, map[string]interface{}{
+			"beat": point.Beat,
+			"bpm":  point.BPM,
+			"ramp": point.Ramp,
+		})
+	}
+
+	return json.Marshal(map[string]interface{}{
+		"bpm":         points[0].BPM,
+		"beatsPerBar": 4.0,
+		"tempo":       tempo,
+		"events":      events,
+	})
+}
+
+// SaveScore writes a score to a script file that LoadScore reads
+func SaveScore(score *Score, filePath string) error {
+	data, err := json.MarshalIndent(score, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(filePath, data, 0644)
+}
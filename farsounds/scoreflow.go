@@ -0,0 +1,167 @@
+package farsounds
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+)
+
+/*
+	Score control flow
+*/
+
+// Minimum length in seconds of the section a jump forever repeats, shorter
+// sections are only a few samples long or less
+const minScoreLoopLength = 0.001
+
+// ScoreMarkerAction marks a position in the score that jumps go to
+type ScoreMarkerAction struct {
+	Name string
+}
+
+// NewScoreMarkerAction new marker action from a name payload
+func NewScoreMarkerAction(payload interface{}) (*ScoreMarkerAction, error) {
+	name, ok := payload.(string)
+	if !ok || name == "" {
+		return nil, errors.New("Marker needs a name")
+	}
+
+	return &ScoreMarkerAction{Name: name}, nil
+}
+
+// Action marker, does nothing
+func (action *ScoreMarkerAction) Action(player *ScorePlayer, module Module, time *float64) {}
+
+// ScoreJumpAction continues the score at a marker, the events at the time of
+// the marker that follow it are played at the sample of the jump
+type ScoreJumpAction struct {
+	// Name of the marker
+	Marker string
+
+	// Number of jumps before the score goes on past the jump, negative jumps
+	// forever. After the last jump the count restarts, so loops can nest
+	Count int
+}
+
+// NewScoreJumpAction new jump action from a marker name payload, which jumps
+// forever, or a payload with marker and count
+func NewScoreJumpAction(payload interface{}) (*ScoreJumpAction, error) {
+	action := ScoreJumpAction{Count: -1}
+
+	switch v := payload.(type) {
+	case string:
+		action.Marker = v
+	case map[string]interface{}:
+		action.Marker, _ = v["marker"].(string)
+
+		if count, ok := v["count"].(float64); ok {
+			action.Count = int(count)
+		}
+	}
+
+	if action.Marker == "" {
+		return nil, errors.New("Jump needs a marker")
+	}
+
+	return &action, nil
+}
+
+// NewScoreLoopAction new jump action that plays the section from a marker
+// repeat times in total, from a payload with marker and repeat
+func NewScoreLoopAction(payload interface{}) (*ScoreJumpAction, error) {
+	values, ok := payload.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Loop needs a marker and a repeat count")
+	}
+
+	marker, _ := values["marker"].(string)
+	repeat, _ := values["repeat"].(float64)
+
+	if marker == "" || repeat < 1.0 {
+		return nil, errors.New("Loop needs a marker and a repeat count of at least 1")
+	}
+
+	return &ScoreJumpAction{Marker: marker, Count: int(repeat) - 1}, nil
+}
+
+// Action jump
+func (action *ScoreJumpAction) Action(player *ScorePlayer, module Module, time *float64) {
+	if action.Count >= 0 {
+		if player.jumpCounts == nil {
+			player.jumpCounts = make(map[*ScoreJumpAction]int)
+		}
+
+		if player.jumpCounts[action] >= action.Count {
+			delete(player.jumpCounts, action)
+			return
+		}
+
+		player.jumpCounts[action]++
+	}
+
+	marker := player.Score.marker(action.Marker)
+	if marker == nil {
+		return
+	}
+
+	sr := module.GetSampleRate()
+	markerTime := player.eventTime(marker.Value.(*ScoreEvent))
+
+	// A jump forever back to the sample of the jump would never end
+	if action.Count < 0 && markerTime <= *time && player.blockOffset(markerTime, sr) >= int64(player.Offset) {
+		return
+	}
+
+	player.moveStreams(*time, markerTime)
+	player.LastEvent = marker.Next()
+	player.moveTo(markerTime, sr)
+	*time = markerTime
+}
+
+// ScoreStopAction stops the player, no more events are played and pattern
+// streams are stopped
+type ScoreStopAction struct{}
+
+// Action stop
+func (action *ScoreStopAction) Action(player *ScorePlayer, module Module, time *float64) {
+	player.LastEvent = nil
+	player.streams = nil
+	player.stopped = true
+}
+
+// marker returns the element of the marker event with name, nil if the
+// score has no such marker
+func (score *Score) marker(name string) *list.Element {
+	for e := score.Events.Front(); e != nil; e = e.Next() {
+		if marker, ok := e.Value.(*ScoreEvent).Action.(*ScoreMarkerAction); ok && marker.Name == name {
+			return e
+		}
+	}
+
+	return nil
+}
+
+// validateMarkers returns an error if a jump goes to a marker the score does
+// not have, or jumps forever back over less than minScoreLoopLength
+func (score *Score) validateMarkers() error {
+	for e := score.Events.Front(); e != nil; e = e.Next() {
+		event := e.Value.(*ScoreEvent)
+
+		jump, ok := event.Action.(*ScoreJumpAction)
+		if !ok {
+			continue
+		}
+
+		marker := score.marker(jump.Marker)
+		if marker == nil {
+			return fmt.Errorf("Score jumps to unknown marker %v", jump.Marker)
+		}
+
+		length := score.seconds(event) - score.seconds(marker.Value.(*ScoreEvent))
+		if jump.Count < 0 && length >= 0.0 && length < minScoreLoopLength {
+			return fmt.Errorf("Score jumps forever to marker %v, which is less than a millisecond back", jump.Marker)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,257 @@
+package farsounds
+
+import "math"
+
+/*
+	Score player transport
+*/
+
+// rate returns the playback rate of the player, rates at or below zero play
+// at normal speed
+func (player *ScorePlayer) rate() float64 {
+	if player.Rate <= 0.0 {
+		return 1.0
+	}
+
+	return player.Rate
+}
+
+// blockOffset returns the sample offset in the current block of a score time
+// in seconds
+func (player *ScorePlayer) blockOffset(time float64, sr float64) int64 {
+	sample := math.Floor(time*sr + 0.5)
+
+	return int64(math.Floor((sample-float64(player.Timestamp)-player.fraction)/player.rate() + 0.5))
+}
+
+// moveTo positions the player so the score time in seconds falls at the
+// current offset in the block
+func (player *ScorePlayer) moveTo(time float64, sr float64) {
+	position := math.Floor(time*sr+0.5) - float64(player.Offset)*player.rate()
+
+	player.Timestamp = int64(math.Floor(position))
+	player.fraction = position - math.Floor(position)
+}
+
+// advance the score time of the player one block of buflen samples
+func (player *ScorePlayer) advance(buflen int64) {
+	position := float64(buflen)*player.rate() + player.fraction
+	step := math.Floor(position)
+
+	player.Timestamp += int64(step)
+	player.fraction = position - step
+}
+
+// seekEvent makes the first event at or after time in seconds the next event
+func (player *ScorePlayer) seekEvent(time float64) {
+	player.LastEvent = player.Score.Events.Front()
+
+	for player.LastEvent != nil && player.eventTime(player.LastEvent.Value.(*ScoreEvent)) < time {
+		player.LastEvent = player.LastEvent.Next()
+	}
+}
+
+// loops returns true if the player has a loop region that plays for at least
+// one sample at the rate of the player, shorter regions would wrap around
+// forever without the block moving on
+func (player *ScorePlayer) loops(sr float64) bool {
+	length := math.Floor(player.LoopEnd*sr+0.5) - math.Floor(player.LoopStart*sr+0.5)
+
+	return length > 0.0 && length >= player.rate()
+}
+
+// Pause the player, events are held until the player resumes
+func (player *ScorePlayer) Pause() {
+	player.Paused = true
+}
+
+// Resume a paused player
+func (player *ScorePlayer) Resume() {
+	player.Paused = false
+}
+
+// Stop the player and rewind it to the start of the score
+func (player *ScorePlayer) Stop() {
+	player.Reset()
+	player.Paused = true
+}
+
+// Seek moves the player to a time in seconds. The player is reset first and
+// the tempo actions before the time are applied, other events before the time
+// are skipped, as are pattern streams that would have started
+func (player *ScorePlayer) Seek(time float64, module Module) {
+	player.Reset()
+
+	for player.LastEvent != nil {
+		event := player.LastEvent.Value.(*ScoreEvent)
+
+		eventTime := player.eventTime(event)
+		if eventTime >= time {
+			break
+		}
+
+		player.LastEvent = player.LastEvent.Next()
+
+		if tempo, ok := event.Action.(*ScoreTempoAction); ok {
+			tempo.Action(player, module, &eventTime)
+		}
+	}
+
+	player.moveTo(time, module.GetSampleRate())
+}
+
+// SetLoop plays the region from start to end in seconds over and over, an
+// end at or before start stops looping. Regions shorter than one sample at
+// the rate of the player do not loop
+func (player *ScorePlayer) SetLoop(start float64, end float64) {
+	player.LoopStart = start
+	player.LoopEnd = end
+}
+
+// Load a score file and play it from the start, the transport settings of
+// the player are kept
+func (player *ScorePlayer) Load(filePath string) error {
+	score, err := LoadScore(filePath)
+	if err != nil {
+		return err
+	}
+
+	player.SetScore(score)
+
+	return nil
+}
+
+// scoreLoad is a score loaded by a load message
+type scoreLoad struct {
+	// Request number of the load
+	id uint64
+
+	score *Score
+
+	// Load message, its other settings apply when the score is played
+	message map[string]interface{}
+}
+
+// load a score on a separate goroutine for a load message
+func (player *ScorePlayer) load(filePath string, message map[string]interface{}, id uint64) {
+	score, err := LoadScore(filePath)
+
+	player.loadMutex.Lock()
+	defer player.loadMutex.Unlock()
+
+	player.err = err
+	if err != nil {
+		return
+	}
+
+	// A later request finished first
+	if current, ok := player.loaded.Load().(*scoreLoad); ok && current.id > id {
+		return
+	}
+
+	player.loaded.Store(&scoreLoad{id: id, score: score, message: message})
+}
+
+// Err returns the error of the last score that failed to load by a load
+// message, nil if the last load succeeded
+func (player *ScorePlayer) Err() error {
+	player.loadMutex.Lock()
+	defer player.loadMutex.Unlock()
+
+	return player.err
+}
+
+// Message controls the transport of the player, module is the patch that
+// plays it. Messages have one or more of
+//
+// play, pause: true or false to play or pause
+//
+// stop: rewind to the start and pause
+//
+// seek: move to a time in seconds
+//
+// rate: playback speed, 1 is normal speed
+//
+// loop: {"start", "end"} in seconds to loop a region, false to stop looping
+//
+// mute: true or false, a muted player plays all events except messages
+//
+// load: a score file to play from the start
+//
+// Messages take effect at the start of the next block the player plays, so a
+// score can send messages to its own player. Scores are loaded on a separate
+// goroutine, the other settings of a load message take effect with the
+// loaded score. A score that fails to load is ignored, see Err
+func (player *ScorePlayer) Message(message Message, module Module) {
+	if timed, ok := message.(*TimedMessage); ok {
+		message = timed.Message
+	}
+
+	valueMap, ok := message.(map[string]interface{})
+	if !ok {
+		return
+	}
+
+	if filePath, ok := valueMap["load"].(string); ok {
+		player.loadRequests++
+		go player.load(filePath, valueMap, player.loadRequests)
+
+		return
+	}
+
+	player.pending = append(player.pending, valueMap)
+}
+
+// applyTransport plays a loaded score and applies the pending messages
+func (player *ScorePlayer) applyTransport(module Module) {
+	if load, ok := player.loaded.Load().(*scoreLoad); ok && load.id > player.loadApplied {
+		player.loadApplied = load.id
+		player.SetScore(load.score)
+		player.applyMessage(load.message, module)
+	}
+
+	for i, valueMap := range player.pending {
+		player.applyMessage(valueMap, module)
+		player.pending[i] = nil
+	}
+
+	player.pending = player.pending[:0]
+}
+
+// applyMessage applies the transport settings of a message, see Message
+func (player *ScorePlayer) applyMessage(valueMap map[string]interface{}, module Module) {
+	if stop, ok := valueMap["stop"].(bool); ok && stop {
+		player.Stop()
+	}
+
+	if time, ok := valueMap["seek"].(float64); ok {
+		player.Seek(time, module)
+	}
+
+	if rate, ok := valueMap["rate"].(float64); ok && rate > 0.0 {
+		player.Rate = rate
+	}
+
+	switch loop := valueMap["loop"].(type) {
+	case map[string]interface{}:
+		start, _ := loop["start"].(float64)
+		end, _ := loop["end"].(float64)
+		player.SetLoop(start, end)
+	case bool:
+		if !loop {
+			player.SetLoop(0.0, 0.0)
+		}
+	}
+
+	if mute, ok := valueMap["mute"].(bool); ok {
+		player.Muted = mute
+	}
+
+	if pause, ok := valueMap["pause"].(bool); ok {
+		player.Paused = pause
+	}
+
+	if play, ok := valueMap["play"].(bool); ok {
+		player.Paused = !play
+	}
+}
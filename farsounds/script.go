@@ -2,6 +2,7 @@ package farsounds
 
 import (
 	"encoding/json"
+	"io"
 	"os"
 	"path/filepath"
 )
@@ -11,6 +12,7 @@ type ScriptMainDescriptor struct {
 	SampleRate    float64                `json:"sampleRate"`
 	BufferLength  int32                  `json:"bufferLength"`
 	PatchSettings map[string]interface{} `json:"patch"`
+	Render        *RenderOptions         `json:"render"`
 }
 
 // UnmarshalFromFile unmarshal a JSON object from file
@@ -89,9 +91,15 @@ func EvalScript(filePath string, eval func(obj interface{}) (interface{}, error)
 
 // LoadMainScript containing samplerate, bufferlength and main patch
 func LoadMainScript(filePath string) (*Patch, error) {
-	_patch, err := EvalInFileDirectory(filePath, func(basePath string) (interface{}, error) {
-		mainDescriptor := ScriptMainDescriptor{}
+	patch, _, err := loadMainScript(filePath)
+	return patch, err
+}
 
+// loadMainScript loads the main patch and the render options from the script
+func loadMainScript(filePath string) (*Patch, *RenderOptions, error) {
+	mainDescriptor := ScriptMainDescriptor{}
+
+	_patch, err := EvalInFileDirectory(filePath, func(basePath string) (interface{}, error) {
 		err := UnmarshalFromFile(basePath, &mainDescriptor)
 		if err != nil {
 			return nil, err
@@ -107,23 +115,83 @@ func LoadMainScript(filePath string) (*Patch, error) {
 	})
 
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 
-	return _patch.(*Patch), nil
+	return _patch.(*Patch), mainDescriptor.Render, nil
 }
 
 // RenderScript load script and generate soundfile
 func RenderScript(scriptPath string, soundFilePath string, numSeconds float64) error {
-	// Load main script with sr, buflen and main patch
-	patch, err := LoadMainScript(scriptPath)
+	return RenderScriptWithOptions(scriptPath, soundFilePath, numSeconds, nil)
+}
+
+// RenderScriptWithOptions load script and generate soundfile with render options,
+// if options is nil the render options from the script are used
+func RenderScriptWithOptions(scriptPath string, soundFilePath string, numSeconds float64, options *RenderOptions) error {
+	_, err := RenderScriptWithStats(scriptPath, soundFilePath, numSeconds, options)
+	return err
+}
+
+// RenderScriptWithStats renders like RenderScriptWithOptions and returns the
+// statistics of every rendered file
+func RenderScriptWithStats(scriptPath string, soundFilePath string, numSeconds float64, options *RenderOptions) ([]*SoundStats, error) {
+	var stats []*SoundStats
+
+	err := renderScript(scriptPath, options, func(source RenderSource, options *RenderOptions) error {
+		var err error
+		stats, err = RenderSourceWithStats(source, soundFilePath, numSeconds, options)
+		return err
+	})
+
+	return stats, err
+}
+
+// RenderScriptToWriter load script and render it as a wav or aiff stream to
+// writer, if options is nil the render options from the script are used
+func RenderScriptToWriter(scriptPath string, writer io.Writer, numSeconds float64, options *RenderOptions) (*SoundStats, error) {
+	var stats *SoundStats
+
+	err := renderScript(scriptPath, options, func(source RenderSource, options *RenderOptions) error {
+		var err error
+		stats, err = RenderSourceToWriter(source, writer, numSeconds, options)
+		return err
+	})
+
+	return stats, err
+}
+
+// renderScript loads the main script and calls render with a render source
+// for the script. The loaded patch is used for the first pass, following
+// passes load the script again
+func renderScript(scriptPath string, options *RenderOptions, render func(source RenderSource, options *RenderOptions) error) error {
+	// Load main script with sr, buflen, main patch and render options
+	patch, scriptOptions, err := loadMainScript(scriptPath)
 	if err != nil {
 		return err
 	}
 
-	// Always clean up patch
-	defer patch.Cleanup()
+	// Clean up patch if the renderer did not use it
+	used := false
+	defer func() {
+		if !used {
+			patch.Cleanup()
+		}
+	}()
+
+	if options == nil {
+		options = scriptOptions
+	}
+
+	source := func() (Module, error) {
+		if !used {
+			used = true
+			return patch, nil
+		}
+
+		return LoadMainScript(scriptPath)
+	}
 
 	// Generate sound file from patch output
-	return patch.Render(soundFilePath, numSeconds)
+	return render(source, options)
 }
@@ -0,0 +1,267 @@
+package farsounds
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+/*
+	Standard MIDI File reader
+*/
+
+// MIDI channel message types, the high nibble of the status byte
+const (
+	midiNoteOff         = 0x80
+	midiNoteOn          = 0x90
+	midiPolyPressure    = 0xA0
+	midiControlChange   = 0xB0
+	midiProgramChange   = 0xC0
+	midiChannelPressure = 0xD0
+	midiPitchBend       = 0xE0
+)
+
+// MIDI meta event types
+const (
+	midiMetaEndOfTrack = 0x2F
+	midiMetaTempo      = 0x51
+)
+
+// midiEvent is a channel or meta event of a MIDI file track
+type midiEvent struct {
+	// Absolute time in ticks
+	tick int64
+
+	// Status byte, 0xFF for meta events
+	status byte
+
+	// Meta event type
+	metaType byte
+
+	// Data bytes of channel events, or the data of meta events
+	data []byte
+}
+
+// midiFile is a parsed Standard MIDI File
+type midiFile struct {
+	// File format 0, 1 or 2
+	format uint16
+
+	// Ticks per quarter note, 0 for SMPTE time
+	ticksPerQuarter int
+
+	// Ticks per second for SMPTE time
+	ticksPerSecond float64
+
+	// Events per track in order of time
+	tracks [][]*midiEvent
+}
+
+// readMIDIFile reads and parses a Standard MIDI File
+func readMIDIFile(filePath string) (*midiFile, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+
+	defer file.Close()
+
+	return parseMIDIFile(bufio.NewReader(file))
+}
+
+// parseMIDIFile parses a Standard MIDI File from r
+func parseMIDIFile(r io.Reader) (*midiFile, error) {
+	header, err := readChunkHeader(r, binary.BigEndian)
+	if err != nil {
+		return nil, err
+	}
+
+	if string(header.id[:]) != "MThd" || header.size < 6 {
+		return nil, errors.New("Not a standard MIDI file")
+	}
+
+	var buf [6]byte
+
+	_, err = io.ReadFull(r, buf[:])
+	if err != nil {
+		return nil, err
+	}
+
+	err = skipChunk(r, header.size-6)
+	if err != nil {
+		return nil, err
+	}
+
+	midi := &midiFile{format: binary.BigEndian.Uint16(buf[0:])}
+	numTracks := int(binary.BigEndian.Uint16(buf[2:]))
+	division := binary.BigEndian.Uint16(buf[4:])
+
+	if division&0x8000 != 0 {
+		framesPerSecond := -float64(int8(division >> 8))
+		midi.ticksPerSecond = framesPerSecond * float64(division&0xFF)
+	} else {
+		midi.ticksPerQuarter = int(division)
+	}
+
+	if midi.ticksPerQuarter == 0 && midi.ticksPerSecond <= 0 {
+		return nil, fmt.Errorf("Invalid MIDI time division %x", division)
+	}
+
+	for len(midi.tracks) < numTracks {
+		header, err := readChunkHeader(r, binary.BigEndian)
+		if err != nil {
+			return nil, err
+		}
+
+		// Skip unknown chunks
+		if string(header.id[:]) != "MTrk" {
+			_, err = io.CopyN(io.Discard, r, int64(header.size))
+			if err != nil {
+				return nil, err
+			}
+
+			continue
+		}
+
+		data := make([]byte, header.size)
+
+		_, err = io.ReadFull(r, data)
+		if err != nil {
+			return nil, err
+		}
+
+		events, err := parseMIDITrack(data)
+		if err != nil {
+			return nil, fmt.Errorf("MIDI track %d: %v", len(midi.tracks), err)
+		}
+
+		midi.tracks = append(midi.tracks, events)
+	}
+
+	return midi, nil
+}
+
+// midiDataLength returns the number of data bytes of a channel message
+func midiDataLength(status byte) int {
+	switch status & 0xF0 {
+	case midiProgramChange, midiChannelPressure:
+		return 1
+	default:
+		return 2
+	}
+}
+
+// parseMIDITrack parses the events of a track chunk, sysex events are skipped
+func parseMIDITrack(data []byte) ([]*midiEvent, error) {
+	var events []*midiEvent
+	var runningStatus byte
+
+	tick := int64(0)
+	pos := 0
+
+	readVarLen := func() (int64, error) {
+		value := int64(0)
+
+		for i := 0; i < 4; i++ {
+			if pos >= len(data) {
+				return 0, io.ErrUnexpectedEOF
+			}
+
+			b := data[pos]
+			pos++
+			value = value<<7 | int64(b&0x7F)
+
+			if b&0x80 == 0 {
+				return value, nil
+			}
+		}
+
+		return 0, errors.New("Variable length quantity too long")
+	}
+
+	readBytes := func(n int64) ([]byte, error) {
+		if n < 0 || int64(pos)+n > int64(len(data)) {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		b := data[pos : pos+int(n)]
+		pos += int(n)
+
+		return b, nil
+	}
+
+	for pos < len(data) {
+		delta, err := readVarLen()
+		if err != nil {
+			return nil, err
+		}
+
+		tick += delta
+
+		if pos >= len(data) {
+			return nil, io.ErrUnexpectedEOF
+		}
+
+		status := data[pos]
+
+		switch {
+		case status == 0xFF:
+			// Meta event
+			pos++
+			metaType, err := readBytes(1)
+			if err != nil {
+				return nil, err
+			}
+
+			length, err := readVarLen()
+			if err != nil {
+				return nil, err
+			}
+
+			metaData, err := readBytes(length)
+			if err != nil {
+				return nil, err
+			}
+
+			events = append(events, &midiEvent{tick: tick, status: status, metaType: metaType[0], data: metaData})
+
+			if metaType[0] == midiMetaEndOfTrack {
+				return events, nil
+			}
+		case status == 0xF0 || status == 0xF7:
+			// Sysex event, cancels running status
+			pos++
+			runningStatus = 0
+
+			length, err := readVarLen()
+			if err != nil {
+				return nil, err
+			}
+
+			_, err = readBytes(length)
+			if err != nil {
+				return nil, err
+			}
+		default:
+			// Channel event, with running status if the data byte follows
+			if status&0x80 != 0 {
+				pos++
+				runningStatus = status
+			} else if runningStatus == 0 {
+				return nil, fmt.Errorf("Data byte %x without status", status)
+			}
+
+			eventData, err := readBytes(int64(midiDataLength(runningStatus)))
+			if err != nil {
+				return nil, err
+			}
+
+			events = append(events, &midiEvent{tick: tick, status: runningStatus, data: eventData})
+		}
+	}
+
+	return events, nil
+}
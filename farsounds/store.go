@@ -0,0 +1,163 @@
+package farsounds
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"os"
+)
+
+/*
+	Sample stores
+*/
+
+// sampleStore keeps written samples until the normalization gain is known
+type sampleStore interface {
+	// Store interleaved samples
+	write(samples []float64) error
+
+	// Replay stored samples in blocks of at most blockSize samples, process
+	// may modify the block
+	replay(blockSize int, process func(samples []float64) error) error
+
+	// Release the storage
+	release() error
+}
+
+// tempFileStore stores raw float64 samples in a temporary file
+type tempFileStore struct {
+	// The temporary file, and its path if it could not be removed while open
+	file     *os.File
+	filePath string
+
+	// Buffered writer on the temporary file
+	writer *bufio.Writer
+
+	// Codec for the raw samples
+	codec *pcmCodec
+
+	// Encode buffer
+	buffer []byte
+}
+
+// newTempFileStore creates a temporary file store in the temp directory. The
+// file is removed right away where open files can be removed, so nothing is
+// left behind if the process is killed
+func newTempFileStore() (*tempFileStore, error) {
+	file, err := os.CreateTemp("", "farsounds-*.raw")
+	if err != nil {
+		return nil, err
+	}
+
+	filePath := file.Name()
+	if os.Remove(filePath) == nil {
+		filePath = ""
+	}
+
+	return &tempFileStore{
+		file:     file,
+		filePath: filePath,
+		writer:   bufio.NewWriter(file),
+		codec:    &pcmCodec{bits: 64, float: true, order: binary.LittleEndian},
+	}, nil
+}
+
+// write samples to the temporary file
+func (s *tempFileStore) write(samples []float64) error {
+	size := len(samples) * 8
+	if len(s.buffer) < size {
+		s.buffer = make([]byte, size)
+	}
+
+	s.codec.encode(samples, s.buffer[:size])
+
+	_, err := s.writer.Write(s.buffer[:size])
+
+	return err
+}
+
+// replay samples from the start of the temporary file
+func (s *tempFileStore) replay(blockSize int, process func(samples []float64) error) error {
+	err := s.writer.Flush()
+	if err != nil {
+		return err
+	}
+
+	_, err = s.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	samples := make([]float64, blockSize)
+	buffer := make([]byte, blockSize*8)
+	reader := bufio.NewReader(s.file)
+
+	for {
+		bytesRead, err := io.ReadFull(reader, buffer)
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		// If we have no more samples then stop
+		numSamples := bytesRead / 8
+		if numSamples == 0 {
+			return nil
+		}
+
+		s.codec.decode(buffer[:bytesRead], samples[:numSamples])
+
+		err = process(samples[:numSamples])
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// release closes and removes the temporary file
+func (s *tempFileStore) release() error {
+	err := s.file.Close()
+	if s.filePath == "" {
+		return err
+	}
+
+	removeErr := os.Remove(s.filePath)
+
+	if err != nil {
+		return err
+	}
+
+	return removeErr
+}
+
+// memoryStore keeps samples in memory
+type memoryStore struct {
+	samples []float64
+}
+
+// write samples to memory
+func (s *memoryStore) write(samples []float64) error {
+	s.samples = append(s.samples, samples...)
+	return nil
+}
+
+// replay samples from memory
+func (s *memoryStore) replay(blockSize int, process func(samples []float64) error) error {
+	block := make([]float64, blockSize)
+
+	for i := 0; i < len(s.samples); i += blockSize {
+		n := copy(block, s.samples[i:])
+
+		err := process(block[:n])
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// release the samples
+func (s *memoryStore) release() error {
+	s.samples = nil
+	return nil
+}
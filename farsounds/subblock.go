@@ -0,0 +1,174 @@
+package farsounds
+
+import (
+	"errors"
+	"fmt"
+)
+
+/*
+	Sub-block patch
+*/
+
+// SubBlockPatch is a container module that runs an internal patch with a
+// smaller block length than its own buffer length. With a block length of 1
+// the internal patch runs one sample at a time, so feedback connections inside
+// the patch have a delay of one sample. This makes it possible to build tight
+// feedback loops like Karplus-Strong, waveguides and feedback FM
+type SubBlockPatch struct {
+	// Ptr to base module implementation
+	*BaseModule
+
+	// Internal patch, created with the sub-block length as buffer length
+	Patch *Patch
+
+	// Length of the internal blocks
+	SubBlockLength int32
+
+	// Timed messages waiting for the sub-block they are due in
+	pending []*subBlockMessage
+}
+
+// subBlockMessage is a timed message for the internal patch
+type subBlockMessage struct {
+	address *Address
+	message Message
+	offset  int32
+}
+
+// NewSubBlockPatch creates a new sub-block patch module around patch. The
+// buffer length of the patch is used as sub-block length and must divide buflen
+func NewSubBlockPatch(patch *Patch, buflen int32, sr float64) (*SubBlockPatch, error) {
+	subBlockLength := patch.GetBufferLength()
+
+	if subBlockLength < 1 || buflen%subBlockLength != 0 {
+		return nil, fmt.Errorf("Sub-block length %d must divide buffer length %d", subBlockLength, buflen)
+	}
+
+	subBlockPatch := new(SubBlockPatch)
+	subBlockPatch.BaseModule = NewBaseModule(len(patch.Inlets), len(patch.Outlets), buflen, sr)
+	subBlockPatch.Parent = subBlockPatch
+	subBlockPatch.Patch = patch
+	subBlockPatch.SubBlockLength = subBlockLength
+
+	return subBlockPatch, nil
+}
+
+// SubBlockPatchFactory creates sub-block patches from settings. Settings
+// contain the block length and the patch settings, which can be a file path
+// to a patch script, like the settings of a normal patch
+func SubBlockPatchFactory(settings interface{}, buflen int32, sr float64) (Module, error) {
+	settingsMap, ok := settings.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Sub-block patch settings error %v", settings)
+	}
+
+	subBlockLength := int32(1)
+
+	if blockLength, ok := settingsMap["blockLength"].(float64); ok {
+		subBlockLength = int32(blockLength)
+	}
+
+	patchSettings, ok := settingsMap["patch"]
+	if !ok {
+		return nil, errors.New("Sub-block patch expected patch settings")
+	}
+
+	if subBlockLength < 1 || buflen%subBlockLength != 0 {
+		return nil, fmt.Errorf("Sub-block length %d must divide buffer length %d", subBlockLength, buflen)
+	}
+
+	patch, err := PatchFactory(patchSettings, subBlockLength, sr)
+	if err != nil {
+		return nil, err
+	}
+
+	return NewSubBlockPatch(patch.(*Patch), buflen, sr)
+}
+
+// DSP runs the internal patch once for every sub-block
+func (module *SubBlockPatch) DSP(timestamp int64) {
+	buflen := module.GetBufferLength()
+	subBlockLength := module.SubBlockLength
+	patch := module.Patch
+
+	for offset := int32(0); offset < buflen; offset += subBlockLength {
+		// Copy part of our inlets to the patch inlets
+		for i, inlet := range module.Inlets {
+			copy(patch.Inlets[i].Buffer, inlet.Buffer[offset:offset+subBlockLength])
+		}
+
+		module.deliverPending(offset)
+
+		patch.DSP(timestamp + int64(offset))
+
+		// Copy patch outlets to part of our outlets
+		for i, outlet := range module.Outlets {
+			copy(outlet.Buffer[offset:offset+subBlockLength], patch.Outlets[i].Buffer)
+		}
+	}
+}
+
+// FastForward fast forwards the internal patch once for every sub-block
+func (module *SubBlockPatch) FastForward(timestamp int64) {
+	for offset := int32(0); offset < module.GetBufferLength(); offset += module.SubBlockLength {
+		module.deliverPending(offset)
+		module.Patch.FastForward(timestamp + int64(offset))
+	}
+}
+
+// Cleanup internal patch
+func (module *SubBlockPatch) Cleanup() {
+	// First call base cleanup
+	module.BaseModule.Cleanup()
+
+	// Cleanup internal patch
+	module.Patch.Cleanup()
+}
+
+// SendMessage passes messages on to the internal patch, timed messages are
+// kept until the sub-block they are due in
+func (module *SubBlockPatch) SendMessage(address *Address, message Message) {
+	timed, ok := message.(*TimedMessage)
+	if !ok {
+		module.Patch.SendMessage(address, message)
+		return
+	}
+
+	module.pending = append(module.pending, &subBlockMessage{
+		address: &Address{
+			Path:       address.Path,
+			Components: append([]string(nil), address.Components...),
+		},
+		message: timed.Message,
+		offset:  timed.Offset,
+	})
+}
+
+// deliverPending sends the pending messages that are due in the sub-block
+// starting at offset to the internal patch
+func (module *SubBlockPatch) deliverPending(offset int32) {
+	if len(module.pending) == 0 {
+		return
+	}
+
+	remaining := module.pending[:0]
+
+	for _, pending := range module.pending {
+		if pending.offset >= offset+module.SubBlockLength {
+			remaining = append(remaining, pending)
+			continue
+		}
+
+		subOffset := pending.offset - offset
+		if subOffset < 0 {
+			subOffset = 0
+		}
+
+		module.Patch.SendMessage(pending.address, &TimedMessage{
+			Message: pending.message,
+			Offset:  subOffset,
+		})
+	}
+
+	module.pending = remaining
+}
@@ -0,0 +1,172 @@
+package farsounds
+
+import (
+	"math"
+	"sort"
+)
+
+/*
+	Tempo map
+*/
+
+// Default tempo in beats per minute
+const defaultBPM = 120.0
+
+// TempoPoint is a tempo change at a beat
+type TempoPoint struct {
+	// Beat of the tempo change
+	Beat float64
+
+	// Tempo in beats per minute from this beat on
+	BPM float64
+
+	// Ramp linearly from the tempo of the previous point to this tempo,
+	// instead of a step at this beat
+	Ramp bool
+}
+
+// TempoMap converts beats to seconds and back with steps and linear ramps
+// in tempo. The first point is always at beat 0
+type TempoMap struct {
+	Points []TempoPoint
+}
+
+// NewTempoMap creates a tempo map with a constant tempo
+func NewTempoMap(bpm float64) *TempoMap {
+	return &TempoMap{
+		Points: []TempoPoint{{Beat: 0.0, BPM: bpm}},
+	}
+}
+
+// Copy returns a copy of the tempo map
+func (tempo *TempoMap) Copy() *TempoMap {
+	return &TempoMap{
+		Points: append([]TempoPoint(nil), tempo.Points...),
+	}
+}
+
+// Add a tempo point, a point at the same beat is replaced
+func (tempo *TempoMap) Add(point TempoPoint) {
+	i := sort.Search(len(tempo.Points), func(i int) bool {
+		return tempo.Points[i].Beat >= point.Beat
+	})
+
+	if i < len(tempo.Points) && tempo.Points[i].Beat == point.Beat {
+		tempo.Points[i] = point
+		return
+	}
+
+	tempo.Points = append(tempo.Points, TempoPoint{})
+	copy(tempo.Points[i+1:], tempo.Points[i:])
+	tempo.Points[i] = point
+}
+
+// SetTempo changes the tempo from beat on, all later points are removed.
+// With rampBeats > 0 the tempo ramps from the current tempo at beat to bpm
+// in rampBeats beats, otherwise it steps to bpm at beat
+func (tempo *TempoMap) SetTempo(beat float64, bpm float64, rampBeats float64) {
+	current := tempo.BPM(beat)
+
+	i := sort.Search(len(tempo.Points), func(i int) bool {
+		return tempo.Points[i].Beat > beat
+	})
+
+	tempo.Points = tempo.Points[:i]
+
+	if rampBeats > 0.0 {
+		tempo.Add(TempoPoint{Beat: beat, BPM: current})
+		tempo.Add(TempoPoint{Beat: beat + rampBeats, BPM: bpm, Ramp: true})
+	} else {
+		tempo.Add(TempoPoint{Beat: beat, BPM: bpm})
+	}
+}
+
+// segment returns the start and end beat and tempo of the segment after
+// point i, the last segment has an infinite length and a constant tempo
+func (tempo *TempoMap) segment(i int) (float64, float64, float64, float64) {
+	p := tempo.Points[i]
+
+	if i+1 == len(tempo.Points) {
+		return p.Beat, math.Inf(1), p.BPM, p.BPM
+	}
+
+	next := tempo.Points[i+1]
+	if next.Ramp && next.Beat > p.Beat {
+		return p.Beat, next.Beat, p.BPM, next.BPM
+	}
+
+	return p.Beat, next.Beat, p.BPM, p.BPM
+}
+
+// BPM returns the tempo at beat
+func (tempo *TempoMap) BPM(beat float64) float64 {
+	for i := range tempo.Points {
+		start, end, bpm0, bpm1 := tempo.segment(i)
+
+		if beat < end {
+			if beat <= start {
+				return bpm0
+			}
+
+			return bpm0 + (bpm1-bpm0)*(beat-start)/(end-start)
+		}
+	}
+
+	return defaultBPM
+}
+
+// Seconds returns the time in seconds of beat
+func (tempo *TempoMap) Seconds(beat float64) float64 {
+	seconds := 0.0
+
+	for i := range tempo.Points {
+		start, end, bpm0, bpm1 := tempo.segment(i)
+
+		if beat <= end {
+			return seconds + segmentSeconds(beat-start, end-start, bpm0, bpm1)
+		}
+
+		seconds += segmentSeconds(end-start, end-start, bpm0, bpm1)
+	}
+
+	return seconds
+}
+
+// Beat returns the beat at a time in seconds
+func (tempo *TempoMap) Beat(seconds float64) float64 {
+	for i := range tempo.Points {
+		start, end, bpm0, bpm1 := tempo.segment(i)
+
+		length := segmentSeconds(end-start, end-start, bpm0, bpm1)
+		if seconds <= length || math.IsInf(end, 1) {
+			return start + segmentBeats(seconds, end-start, bpm0, bpm1)
+		}
+
+		seconds -= length
+	}
+
+	return 0.0
+}
+
+// segmentSeconds returns the seconds of the first beats of a segment of
+// length beats in which the tempo ramps linearly from bpm0 to bpm1
+func segmentSeconds(beats float64, length float64, bpm0 float64, bpm1 float64) float64 {
+	if bpm0 == bpm1 {
+		return 60.0 * beats / bpm0
+	}
+
+	slope := (bpm1 - bpm0) / length
+
+	return 60.0 / slope * math.Log(1.0+slope*beats/bpm0)
+}
+
+// segmentBeats is the inverse of segmentSeconds
+func segmentBeats(seconds float64, length float64, bpm0 float64, bpm1 float64) float64 {
+	if bpm0 == bpm1 {
+		return seconds * bpm0 / 60.0
+	}
+
+	slope := (bpm1 - bpm0) / length
+
+	return bpm0 / slope * (math.Exp(seconds*slope/60.0) - 1.0)
+}
@@ -0,0 +1,202 @@
+package farsounds
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+/*
+	Pure Go WAV codec
+*/
+
+const (
+	wavFormatPCM        = 0x0001
+	wavFormatFloat      = 0x0003
+	wavFormatExtensible = 0xFFFE
+)
+
+// GUID tail of the WAVE_FORMAT_EXTENSIBLE sub format
+var wavSubFormatGUID = []byte{0x00, 0x00, 0x00, 0x00, 0x10, 0x00, 0x80, 0x00, 0x00, 0xAA, 0x00, 0x38, 0x9B, 0x71}
+
+// writeWAVHeader writes the RIFF, fmt and data chunk headers, numFrames is -1
+// if the number of frames is not known
+func writeWAVHeader(w io.Writer, channels int32, samplerate int32, codec *pcmCodec, numFrames int64) error {
+	le := binary.LittleEndian
+	blockAlign := uint32(channels) * uint32(codec.bytesPerSample())
+
+	formatTag := uint16(wavFormatPCM)
+	if codec.float {
+		formatTag = wavFormatFloat
+	}
+
+	// More than 2 channels need the extensible format
+	extensible := channels > 2
+
+	fmtSize := uint32(16)
+	if extensible {
+		fmtSize = 40
+	} else if codec.float {
+		fmtSize = 18
+	}
+
+	// Non PCM formats need a fact chunk
+	factSize := uint32(0)
+	if codec.float {
+		factSize = 12
+	}
+
+	dataSize := uint32(0xFFFFFFFF)
+	riffSize := uint32(0xFFFFFFFF)
+	factFrames := uint32(0xFFFFFFFF)
+
+	if numFrames >= 0 {
+		size := uint64(numFrames) * uint64(blockAlign)
+		if size+uint64(fmtSize)+uint64(factSize)+20 > 0xFFFFFFFF {
+			return errors.New("Sound file too large for wav")
+		}
+
+		dataSize = uint32(size)
+		riffSize = 4 + 8 + fmtSize + factSize + 8 + dataSize + (dataSize & 1)
+		factFrames = uint32(numFrames)
+	}
+
+	header := make([]byte, 0, 80)
+
+	header = append(header, "RIFF"...)
+	header = le.AppendUint32(header, riffSize)
+	header = append(header, "WAVE"...)
+
+	header = append(header, "fmt "...)
+	header = le.AppendUint32(header, fmtSize)
+
+	if extensible {
+		header = le.AppendUint16(header, wavFormatExtensible)
+	} else {
+		header = le.AppendUint16(header, formatTag)
+	}
+
+	header = le.AppendUint16(header, uint16(channels))
+	header = le.AppendUint32(header, uint32(samplerate))
+	header = le.AppendUint32(header, uint32(samplerate)*blockAlign)
+	header = le.AppendUint16(header, uint16(blockAlign))
+	header = le.AppendUint16(header, uint16(codec.bits))
+
+	if extensible {
+		header = le.AppendUint16(header, 22)
+		header = le.AppendUint16(header, uint16(codec.bits))
+		header = le.AppendUint32(header, 0)
+		header = le.AppendUint16(header, formatTag)
+		header = append(header, wavSubFormatGUID...)
+	} else if codec.float {
+		header = le.AppendUint16(header, 0)
+	}
+
+	if codec.float {
+		header = append(header, "fact"...)
+		header = le.AppendUint32(header, 4)
+		header = le.AppendUint32(header, factFrames)
+	}
+
+	header = append(header, "data"...)
+	header = le.AppendUint32(header, dataSize)
+
+	_, err := w.Write(header)
+
+	return err
+}
+
+// readWAVHeader reads chunks up to the data chunk
+func readWAVHeader(r io.Reader) (*pcmReader, error) {
+	le := binary.LittleEndian
+
+	// Skip RIFF header, already checked
+	_, err := io.CopyN(io.Discard, r, 12)
+	if err != nil {
+		return nil, err
+	}
+
+	var codec *pcmCodec
+	info := soundFileInfo{}
+	blockAlign := uint32(0)
+
+	for {
+		header, err := readChunkHeader(r, le)
+		if err != nil {
+			return nil, err
+		}
+
+		switch string(header.id[:]) {
+		case "fmt ":
+			if header.size < 16 {
+				return nil, errors.New("Invalid wav fmt chunk")
+			}
+
+			body := make([]byte, header.size+header.size&1)
+
+			_, err = io.ReadFull(r, body)
+			if err != nil {
+				return nil, err
+			}
+
+			formatTag := le.Uint16(body[0:])
+			info.channels = int32(le.Uint16(body[2:]))
+			info.samplerate = int32(le.Uint32(body[4:]))
+			blockAlign = uint32(le.Uint16(body[12:]))
+			bits := int(le.Uint16(body[14:]))
+
+			if formatTag == wavFormatExtensible {
+				if header.size < 26 {
+					return nil, errors.New("Invalid wav extensible fmt chunk")
+				}
+
+				formatTag = le.Uint16(body[24:])
+			}
+
+			switch formatTag {
+			case wavFormatPCM:
+				if !isPCMBits(bits) {
+					return nil, fmt.Errorf("Unsupported wav sample size %d", bits)
+				}
+
+				codec = &pcmCodec{bits: bits, order: le, unsigned8: true}
+			case wavFormatFloat:
+				if bits != 32 && bits != 64 {
+					return nil, fmt.Errorf("Unsupported wav float size %d", bits)
+				}
+
+				codec = &pcmCodec{bits: bits, float: true, order: le}
+			default:
+				return nil, fmt.Errorf("Unsupported wav format %d", formatTag)
+			}
+
+			if info.channels < 1 || blockAlign != uint32(info.channels)*uint32(codec.bytesPerSample()) {
+				return nil, errors.New("Invalid wav block align")
+			}
+		case "data":
+			if codec == nil {
+				return nil, errors.New("Wav data chunk before fmt chunk")
+			}
+
+			pcm := &pcmReader{codec: codec}
+
+			if header.size == 0xFFFFFFFF {
+				// Streamed wav, size is unknown
+				info.frames = -1
+			} else {
+				info.frames = int64(header.size / blockAlign)
+			}
+
+			pcm.info = info
+			pcm.remaining = info.frames * int64(info.channels)
+
+			return pcm, nil
+		default:
+			err = skipChunk(r, header.size)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+}